@@ -0,0 +1,166 @@
+package certstreamorc
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	sentinelpsl "github.com/gakiwate/sentinel-orchestra/sentinel-psl"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// SentinelDBCertName is the part of a subject or issuer we keep
+type SentinelDBCertName struct {
+	Aggregated   string `json:"aggregated"`
+	CommonName   string `json:"cn,omitempty"`
+	Organization string `json:"o,omitempty"`
+	Country      string `json:"c,omitempty"`
+}
+
+// SentinelDBChainCert summarizes a certificate of the chain
+type SentinelDBChainCert struct {
+	SHA1    string             `json:"sha1"`
+	Subject SentinelDBCertName `json:"subject"`
+	Issuer  SentinelDBCertName `json:"issuer"`
+}
+
+// SentinelDBCert is stored under certstream|cert|<sha1>
+type SentinelDBCert struct {
+	SHA1               string                  `json:"sha1"`
+	CertType           string                  `json:"cert_type"`
+	Serial             string                  `json:"serial"`
+	Subject            SentinelDBCertName      `json:"subject"`
+	Issuer             SentinelDBCertName      `json:"issuer"`
+	NotBefore          int64                   `json:"not_before"`
+	NotAfter           int64                   `json:"not_after"`
+	SANs               []string                `json:"sans"`
+	KeyType            string                  `json:"key_type,omitempty"`
+	KeyBits            int                     `json:"key_bits,omitempty"`
+	SignatureAlgorithm string                  `json:"signature_algorithm,omitempty"`
+	Chain              []SentinelDBChainCert   `json:"chain"`
+	Source             schema.CertstreamSource `json:"source"`
+	CertIndex          int64                   `json:"cert_index"`
+	CertLink           string                  `json:"cert_link"`
+	Seen               int64                   `json:"seen"`
+}
+
+// SentinelDBDomainCert is appended to certstream|certs|<domain> for every
+// certificate naming the domain. The registrable domain index also carries
+// the domain.
+type SentinelDBDomainCert struct {
+	Domain   string `json:"domain,omitempty"`
+	CertSHA1 string `json:"cert_sha1"`
+	CertType string `json:"cert_type"`
+	Seen     int64  `json:"seen"`
+}
+
+func certName(name map[string]string) SentinelDBCertName {
+	return SentinelDBCertName{
+		Aggregated:   name["aggregated"],
+		CommonName:   name["CN"],
+		Organization: name["O"],
+		Country:      name["C"],
+	}
+}
+
+// certKey reads the public key from the DER certificate, which certstream
+// only sends on its full stream
+func certKey(cert schema.CertstreamCert) (string, int, string) {
+	if cert.AsDER == "" {
+		return "", 0, cert.SignatureAlgorithm
+	}
+	der, err := base64.StdEncoding.DecodeString(cert.AsDER)
+	if err != nil {
+		return "", 0, cert.SignatureAlgorithm
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", 0, cert.SignatureAlgorithm
+	}
+
+	signatureAlgorithm := parsed.SignatureAlgorithm.String()
+	switch key := parsed.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", key.N.BitLen(), signatureAlgorithm
+	case *ecdsa.PublicKey:
+		return "ECDSA", key.Curve.Params().BitSize, signatureAlgorithm
+	case ed25519.PublicKey:
+		return "Ed25519", 256, signatureAlgorithm
+	}
+	return parsed.PublicKeyAlgorithm.String(), 0, signatureAlgorithm
+}
+
+func certRecord(event schema.CertstreamEvent, certSHA1 string, seen int64) SentinelDBCert {
+	leaf := event.Data.LeafCert
+	keyType, keyBits, signatureAlgorithm := certKey(leaf)
+	chain := []SentinelDBChainCert{}
+	for _, cert := range event.Data.Chain {
+		chain = append(chain, SentinelDBChainCert{
+			SHA1:    utils.FormatSHA1(cert.Fingerprint),
+			Subject: certName(cert.Subject),
+			Issuer:  certName(cert.Issuer),
+		})
+	}
+	return SentinelDBCert{
+		SHA1:               certSHA1,
+		CertType:           event.Data.UpdateType,
+		Serial:             leaf.SerialNumber,
+		Subject:            certName(leaf.Subject),
+		Issuer:             certName(leaf.Issuer),
+		NotBefore:          int64(leaf.NotBefore),
+		NotAfter:           int64(leaf.NotAfter),
+		SANs:               leaf.AllDomains,
+		KeyType:            keyType,
+		KeyBits:            keyBits,
+		SignatureAlgorithm: signatureAlgorithm,
+		Chain:              chain,
+		Source:             event.Data.Source,
+		CertIndex:          event.Data.CertIndex,
+		CertLink:           event.Data.CertLink,
+		Seen:               seen,
+	}
+}
+
+// recordCert stores the certificate and indexes it under each in scope domain
+func (o *SentinelCertstreamOrchestrator) recordCert(event schema.CertstreamEvent, certSHA1 string, domains []string) {
+	seen := o.eventSeen(event)
+	value, err := json.Marshal(certRecord(event, certSHA1, seen))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := o.db.Set(fmt.Sprintf("certstream|cert|%s", certSHA1), value); err != nil {
+		log.Error(err)
+		return
+	}
+	o.monitor.Incr(mon.CertstreamCertRecords)
+
+	for _, domain := range domains {
+		index := SentinelDBDomainCert{
+			CertSHA1: certSHA1,
+			CertType: event.Data.UpdateType,
+			Seen:     seen,
+		}
+		value, err := json.Marshal(index)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		o.db.AddResult(fmt.Sprintf("certstream|certs|%s", domain), value)
+
+		index.Domain = domain
+		value, err = json.Marshal(index)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		sentinelpsl.Index(o.db, o.monitor, "certstream", domain, value)
+	}
+}
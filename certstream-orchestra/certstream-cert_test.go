@@ -0,0 +1,85 @@
+package certstreamorc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	db "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	testutils "github.com/gakiwate/sentinel-orchestra/sentinel-testutils"
+)
+
+func TestCertRecord(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	monitor := mon.NewTestSentinelMonitor("certstream-cert-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-cert-test")
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, broker, "zdns", CertstreamConfig{
+		Filter: CertstreamFilterConfig{DenySuffixes: []string{"other.domain"}},
+	})
+
+	event := schema.CertstreamEvent{
+		MessageType: "certificate_update",
+		Data: schema.CertstreamData{
+			UpdateType: "PrecertLogEntry",
+			LeafCert: schema.CertstreamCert{
+				AllDomains:   []string{"a.valid.domain", "*.b.valid.domain", "other.domain"},
+				Fingerprint:  "AA:BB",
+				SerialNumber: "0A1B2C",
+				NotBefore:    1677661200,
+				NotAfter:     1685437200,
+				Subject:      map[string]string{"aggregated": "/CN=a.valid.domain", "CN": "a.valid.domain"},
+				Issuer:       map[string]string{"aggregated": "/C=US/O=Let's Encrypt/CN=R3", "CN": "R3", "O": "Let's Encrypt", "C": "US"},
+				AsDER:        base64.StdEncoding.EncodeToString(testutils.Certificate(t, testutils.TestCert{Serial: 0x0A1B2C, Domains: []string{"a.valid.domain"}})),
+			},
+			Chain: []schema.CertstreamCert{{
+				Fingerprint: "CC:DD",
+				Subject:     map[string]string{"aggregated": "/C=US/O=Let's Encrypt/CN=R3", "CN": "R3"},
+				Issuer:      map[string]string{"aggregated": "/C=US/O=Internet Security Research Group/CN=ISRG Root X1"},
+			}},
+			CertIndex: 42,
+			Seen:      1677664800,
+			Source:    schema.CertstreamSource{Name: "Test Log", URL: "https://ct.valid.domain/"},
+		},
+	}
+	jsonEvent, _ := schema.Marshal(&event)
+	if err := o.ProcessEvent(jsonEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	value, _ := sdb.Get("certstream|cert|aabb")
+	var cert SentinelDBCert
+	if err := json.Unmarshal(value, &cert); err != nil {
+		t.Fatalf("Unable to read certificate %s: %s", value, err)
+	}
+	if cert.Issuer.CommonName != "R3" || cert.Serial != "0A1B2C" || cert.NotAfter != 1685437200 {
+		t.Errorf("Unexpected certificate %+v", cert)
+	}
+	if cert.KeyType != "ECDSA" || cert.KeyBits != 256 || cert.SignatureAlgorithm != "ECDSA-SHA256" {
+		t.Errorf("Expected an ECDSA P-256 key but got %s %d %s", cert.KeyType, cert.KeyBits, cert.SignatureAlgorithm)
+	}
+	if len(cert.Chain) != 1 || cert.Chain[0].SHA1 != "ccdd" || cert.Chain[0].Issuer.Aggregated == "" {
+		t.Errorf("Unexpected chain %+v", cert.Chain)
+	}
+	if cert.Source.Name != "Test Log" || cert.CertIndex != 42 || len(cert.SANs) != 3 || cert.SANs[1] != "*.b.valid.domain" {
+		t.Errorf("Unexpected source or SANs %+v", cert)
+	}
+
+	value, _ = sdb.Get("certstream|certs|b.valid.domain")
+	var index SentinelDBDomainCert
+	if err := json.Unmarshal(bytes.TrimSpace(value), &index); err != nil {
+		t.Fatalf("Unable to read index %s: %s", value, err)
+	}
+	if index.CertSHA1 != "aabb" || index.Seen != 1677664800 {
+		t.Errorf("Unexpected index %+v", index)
+	}
+	// out of scope domains are not indexed
+	value, _ = sdb.Get("certstream|certs|other.domain")
+	if len(value) != 0 {
+		t.Errorf("Expected no index for other.domain but got %s", value)
+	}
+}
@@ -0,0 +1,147 @@
+package certstreamorc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	log "github.com/sirupsen/logrus"
+)
+
+const dedupPrefix = "certstream|seen|"
+
+// CertstreamDedupConfig suppresses scheduling a domain again while it was
+// already sent to zdns within Window. Certificates are still recorded under
+// certstream|sha1|<domain>. A zero Window disables deduplication.
+type CertstreamDedupConfig struct {
+	Window time.Duration `yaml:"window"`
+	// SweepInterval is how often expired entries are removed from the store
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+}
+
+func (cfg CertstreamDedupConfig) withDefaults() CertstreamDedupConfig {
+	if cfg.Window > 0 && cfg.SweepInterval <= 0 {
+		cfg.SweepInterval = cfg.Window
+	}
+	return cfg
+}
+
+func dedupKey(domain string) string {
+	return dedupPrefix + domain
+}
+
+// recentlyScheduled reports whether the domain was sent to zdns within the
+// dedup window
+func (o *SentinelCertstreamOrchestrator) recentlyScheduled(domain string) bool {
+	if o.dedupCfg.Window <= 0 {
+		return false
+	}
+	value, _ := o.db.Get(dedupKey(domain))
+	if len(value) == 0 {
+		return false
+	}
+	scheduled, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return false
+	}
+	return o.clock.Now().Unix()-scheduled < int64(o.dedupCfg.Window.Seconds())
+}
+
+// reserve marks the domain as sent to zdns at tnow unless it already was
+// within the dedup window, and reports whether it may be sent
+func (o *SentinelCertstreamOrchestrator) reserve(domain string, tnow int64) bool {
+	if o.dedupCfg.Window <= 0 {
+		return true
+	}
+	o.dedupMu.Lock()
+	defer o.dedupMu.Unlock()
+	if o.recentlyScheduled(domain) {
+		return false
+	}
+	err := o.db.Set(dedupKey(domain), []byte(strconv.FormatInt(tnow, 10)))
+	if err != nil {
+		log.Error(err)
+	}
+	return true
+}
+
+// unreserve drops the reservation of a domain that could not be sent
+func (o *SentinelCertstreamOrchestrator) unreserve(domain string) {
+	if o.dedupCfg.Window <= 0 {
+		return
+	}
+	o.dedupMu.Lock()
+	defer o.dedupMu.Unlock()
+	if err := o.db.Delete(dedupKey(domain)); err != nil {
+		log.Error(err)
+	}
+}
+
+// SweepDedup removes entries older than the dedup window and returns how
+// many were removed
+func (o *SentinelCertstreamOrchestrator) SweepDedup() int {
+	o.dedupMu.Lock()
+	defer o.dedupMu.Unlock()
+	cutoff := o.clock.Now().Unix() - int64(o.dedupCfg.Window.Seconds())
+	expired := o.sweep([]byte(dedupPrefix), func(value []byte) bool {
+		scheduled, err := strconv.ParseInt(string(value), 10, 64)
+		return err != nil || scheduled <= cutoff
+	})
+	o.monitor.IncrBy(mon.CertstreamDedupExpired, int64(expired))
+	return expired
+}
+
+// sweep deletes the keys under prefix whose value has expired
+func (o *SentinelCertstreamOrchestrator) sweep(prefix []byte, expired func(value []byte) bool) int {
+	keys := []string{}
+	iter := o.db.FetchAllKeysIterator(prefix)
+	for iter.First(); iter.Valid(); iter.Next() {
+		if expired(iter.Value()) {
+			keys = append(keys, string(iter.Key()))
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log.Error(err)
+	}
+
+	for _, key := range keys {
+		if err := o.db.Delete(key); err != nil {
+			log.Error(err)
+		}
+	}
+	return len(keys)
+}
+
+// Sweep expires dedup entries and precertificates past the link window until
+// ctx is done. Both certstream and the CT log poller write them, so it runs as
+// a stage of its own.
+func (o *SentinelCertstreamOrchestrator) Sweep(ctx context.Context) error {
+	interval := time.Duration(0)
+	if o.dedupCfg.Window > 0 {
+		interval = o.dedupCfg.SweepInterval
+	}
+	if o.x509Cfg.Link && (interval == 0 || o.x509Cfg.LinkWindow < interval) {
+		interval = o.x509Cfg.LinkWindow
+	}
+	if interval == 0 {
+		<-ctx.Done()
+		return nil
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if o.dedupCfg.Window > 0 {
+				log.Info(fmt.Sprintf("Certstream: expired %d dedup entries", o.SweepDedup()))
+			}
+			if o.x509Cfg.Link {
+				log.Info(fmt.Sprintf("Certstream: expired %d precertificates", o.SweepPrecerts()))
+			}
+		}
+	}
+}
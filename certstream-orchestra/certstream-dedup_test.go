@@ -0,0 +1,147 @@
+package certstreamorc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	db "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+)
+
+func TestDedupWindow(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	monitor := mon.NewTestSentinelMonitor("certstream-dedup-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-dedup-test")
+	clock := utils.NewFakeClock(time.Unix(1000, 0))
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, broker, "zdns", CertstreamConfig{
+		Dedup: CertstreamDedupConfig{Window: time.Hour},
+	})
+	o.SetClock(clock)
+
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "AA:AA", "01", 1000, `"a.valid.domain"`))
+	clock.Advance(30 * time.Minute)
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "BB:BB", "02", 2800, `"a.valid.domain", "b.valid.domain"`))
+
+	if broker.Depth("zdns") != 2 {
+		t.Errorf("Expected 2 zdns inputs but got %d", broker.Depth("zdns"))
+	}
+	suppressed := monitor.Count(mon.CertstreamDedupSuppressed)
+	if suppressed != 1 {
+		t.Errorf("Expected 1 suppressed domain but got %d", suppressed)
+	}
+	// both certificates are still associated with the domain
+	value, _ := sdb.Get("certstream|sha1|a.valid.domain")
+	if bytes.Count(value, []byte("\n")) != 2 {
+		t.Errorf("Expected 2 certificates for a.valid.domain but got %s", value)
+	}
+
+	// a.valid.domain was scheduled at 1000 and expires first
+	clock.Advance(45 * time.Minute)
+	if n := o.SweepDedup(); n != 1 {
+		t.Errorf("Expected 1 expired entry but got %d", n)
+	}
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "CC:CC", "03", 5500, `"a.valid.domain", "b.valid.domain"`))
+	if broker.Depth("zdns") != 3 {
+		t.Errorf("Expected 3 zdns inputs but got %d", broker.Depth("zdns"))
+	}
+}
+
+func TestDedupDisabled(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	monitor := mon.NewTestSentinelMonitor("certstream-nodedup-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-nodedup-test")
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, broker, "zdns", CertstreamConfig{})
+
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "AA:AA", "01", 1000, `"a.valid.domain"`))
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "BB:BB", "02", 1000, `"a.valid.domain"`))
+	if broker.Depth("zdns") != 2 {
+		t.Errorf("Expected 2 zdns inputs but got %d", broker.Depth("zdns"))
+	}
+}
+
+// Entries written by the CT log poller expire without certstream running
+func TestDedupSweep(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	monitor := mon.NewTestSentinelMonitor("certstream-sweep-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-sweep-test")
+	clock := utils.NewFakeClock(time.Unix(1000, 0))
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, broker, "zdns", CertstreamConfig{
+		Dedup: CertstreamDedupConfig{Window: time.Hour, SweepInterval: 10 * time.Millisecond},
+	})
+	o.SetClock(clock)
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "AA:AA", "01", 1000, `"a.valid.domain"`))
+	clock.Advance(2 * time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- o.Sweep(ctx) }()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if value, _ := sdb.Get(dedupKey("a.valid.domain")); len(value) == 0 {
+			break
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected the sweep to stop cleanly but got %s", err)
+	}
+	if expired := monitor.Count(mon.CertstreamDedupExpired); expired != 1 {
+		t.Errorf("Expected 1 expired entry but got %d", expired)
+	}
+}
+
+func TestDedupConcurrentSources(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	monitor := mon.NewTestSentinelMonitor("certstream-dedup-concurrent-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-dedup-concurrent-test")
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, broker, "zdns", CertstreamConfig{
+		Dedup: CertstreamDedupConfig{Window: time.Hour},
+	})
+	o.SetClock(utils.NewFakeClock(time.Unix(1000, 0)))
+
+	// certstream and the CT log poller see the same name at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			o.ProcessEvent(testCertEvent("PrecertLogEntry", fmt.Sprintf("AA:%02X", i), "01", 1000, `"a.valid.domain"`))
+		}(i)
+	}
+	wg.Wait()
+	if broker.Depth("zdns") != 1 {
+		t.Errorf("Expected a.valid.domain to be sent once but got %d", broker.Depth("zdns"))
+	}
+}
+
+// failingBroker refuses every message
+type failingBroker struct {
+	sentinelbroker.Broker
+}
+
+func (b failingBroker) Publish(topic string, body []byte) error {
+	return fmt.Errorf("broker unavailable")
+}
+
+func TestDedupPublishFailure(t *testing.T) {
+	monitor := mon.NewTestSentinelMonitor("certstream-dedup-failure-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-dedup-failure-test")
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, failingBroker{}, "zdns", CertstreamConfig{
+		Dedup: CertstreamDedupConfig{Window: time.Hour},
+	})
+	o.SetClock(utils.NewFakeClock(time.Unix(1000, 0)))
+
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "AA:AA", "01", 1000, `"a.valid.domain"`))
+	if o.recentlyScheduled("a.valid.domain") {
+		t.Errorf("Expected the reservation to be dropped when publishing fails")
+	}
+}
@@ -0,0 +1,159 @@
+package certstreamorc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	sentinelpsl "github.com/gakiwate/sentinel-orchestra/sentinel-psl"
+	"golang.org/x/net/idna"
+)
+
+// IDN handling modes
+const (
+	IDNAllow = "allow"
+	IDNDeny  = "deny"
+	IDNOnly  = "only"
+)
+
+// CertstreamFilterConfig scopes which domains are sent to zdns. Deny rules
+// win over allow rules. When any allow rule is configured a domain has to
+// match at least one of them.
+type CertstreamFilterConfig struct {
+	AllowSuffixes    []string `yaml:"allow_suffixes"`
+	DenySuffixes     []string `yaml:"deny_suffixes"`
+	Include          []string `yaml:"include"`
+	Exclude          []string `yaml:"exclude"`
+	AllowRegistrable []string `yaml:"allow_registrable"`
+	DenyRegistrable  []string `yaml:"deny_registrable"`
+	// MaxDepth limits the number of labels in front of the registrable
+	// domain. 0 disables the limit.
+	MaxDepth int `yaml:"max_depth"`
+	// IDN is one of allow, deny (drop internationalized names) or only
+	// (drop everything else). Invalid punycode is always dropped.
+	IDN string `yaml:"idn"`
+}
+
+type regexRule struct {
+	expr string
+	re   *regexp.Regexp
+}
+
+// DomainFilter applies a CertstreamFilterConfig. Every decision names the
+// rule that made it so hits can be counted per rule.
+type DomainFilter struct {
+	cfg     CertstreamFilterConfig
+	include []regexRule
+	exclude []regexRule
+}
+
+func NewDomainFilter(cfg CertstreamFilterConfig) (*DomainFilter, error) {
+	f := &DomainFilter{cfg: cfg}
+	switch cfg.IDN {
+	case "":
+		f.cfg.IDN = IDNAllow
+	case IDNAllow, IDNDeny, IDNOnly:
+	default:
+		return nil, fmt.Errorf("filter: unknown idn mode %s", cfg.IDN)
+	}
+	for _, expr := range cfg.Include {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("filter: include %s: %w", expr, err)
+		}
+		f.include = append(f.include, regexRule{expr: expr, re: re})
+	}
+	for _, expr := range cfg.Exclude {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("filter: exclude %s: %w", expr, err)
+		}
+		f.exclude = append(f.exclude, regexRule{expr: expr, re: re})
+	}
+	return f, nil
+}
+
+func hasSuffix(domain string, suffix string) bool {
+	suffix = strings.ToLower(strings.TrimPrefix(suffix, "."))
+	return domain == suffix || strings.HasSuffix(domain, "."+suffix)
+}
+
+func isIDN(domain string) bool {
+	for _, label := range strings.Split(domain, ".") {
+		if strings.HasPrefix(label, "xn--") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *DomainFilter) allowRules() bool {
+	return len(f.cfg.AllowSuffixes) > 0 || len(f.cfg.AllowRegistrable) > 0 || len(f.include) > 0
+}
+
+// Match reports whether the domain should be scanned and the rule that
+// decided it
+func (f *DomainFilter) Match(domain string) (bool, string) {
+	domain = strings.ToLower(domain)
+
+	idn := isIDN(domain)
+	if idn {
+		if _, err := idna.Lookup.ToUnicode(domain); err != nil {
+			return false, "idn|invalid"
+		}
+	}
+	if idn && f.cfg.IDN == IDNDeny {
+		return false, "idn|deny"
+	}
+	if !idn && f.cfg.IDN == IDNOnly {
+		return false, "idn|only"
+	}
+
+	registrable, err := sentinelpsl.Registrable(domain)
+	if err != nil {
+		// a public suffix itself, or not a domain name at all
+		registrable = ""
+	}
+	if f.cfg.MaxDepth > 0 && registrable != "" {
+		depth := strings.Count(domain, ".") - strings.Count(registrable, ".")
+		if depth > f.cfg.MaxDepth {
+			return false, "max_depth"
+		}
+	}
+
+	for _, suffix := range f.cfg.DenySuffixes {
+		if hasSuffix(domain, suffix) {
+			return false, "deny_suffix|" + suffix
+		}
+	}
+	for _, name := range f.cfg.DenyRegistrable {
+		if registrable == strings.ToLower(name) {
+			return false, "deny_registrable|" + name
+		}
+	}
+	for _, rule := range f.exclude {
+		if rule.re.MatchString(domain) {
+			return false, "exclude|" + rule.expr
+		}
+	}
+
+	if !f.allowRules() {
+		return true, "default"
+	}
+	for _, suffix := range f.cfg.AllowSuffixes {
+		if hasSuffix(domain, suffix) {
+			return true, "allow_suffix|" + suffix
+		}
+	}
+	for _, name := range f.cfg.AllowRegistrable {
+		if registrable == strings.ToLower(name) {
+			return true, "allow_registrable|" + name
+		}
+	}
+	for _, rule := range f.include {
+		if rule.re.MatchString(domain) {
+			return true, "include|" + rule.expr
+		}
+	}
+	return false, "not_allowed"
+}
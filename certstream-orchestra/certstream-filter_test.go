@@ -0,0 +1,100 @@
+package certstreamorc
+
+import (
+	"testing"
+
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	db "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+)
+
+func TestDomainFilter(t *testing.T) {
+	f, err := NewDomainFilter(CertstreamFilterConfig{
+		AllowSuffixes:    []string{"edu"},
+		DenySuffixes:     []string{"test.ucsd.edu"},
+		Include:          []string{`^mail\.`},
+		Exclude:          []string{`^dev-`},
+		AllowRegistrable: []string{"example.co.uk"},
+		DenyRegistrable:  []string{"blocked.edu"},
+		MaxDepth:         2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain string
+		ok     bool
+		rule   string
+	}{
+		{"www.ucsd.edu", true, "allow_suffix|edu"},
+		{"a.test.ucsd.edu", false, "deny_suffix|test.ucsd.edu"},
+		{"www.blocked.edu", false, "deny_registrable|blocked.edu"},
+		{"dev-www.ucsd.edu", false, "exclude|^dev-"},
+		{"shop.example.co.uk", true, "allow_registrable|example.co.uk"},
+		{"mail.other.com", true, "include|^mail\\."},
+		{"www.other.com", false, "not_allowed"},
+		{"a.b.c.ucsd.edu", false, "max_depth"},
+		{"WWW.UCSD.EDU", true, "allow_suffix|edu"},
+	}
+	for _, test := range tests {
+		ok, rule := f.Match(test.domain)
+		if ok != test.ok || rule != test.rule {
+			t.Errorf("%s: expected %v %s but got %v %s", test.domain, test.ok, test.rule, ok, rule)
+		}
+	}
+}
+
+func TestDomainFilterIDN(t *testing.T) {
+	tests := []struct {
+		mode   string
+		domain string
+		ok     bool
+	}{
+		{IDNAllow, "xn--bcher-kva.example", true},
+		{IDNAllow, "www.example.com", true},
+		{IDNDeny, "xn--bcher-kva.example", false},
+		{IDNDeny, "www.example.com", true},
+		{IDNOnly, "xn--bcher-kva.example", true},
+		{IDNOnly, "www.example.com", false},
+		{IDNAllow, "xn--a.example", false},
+	}
+	for _, test := range tests {
+		f, err := NewDomainFilter(CertstreamFilterConfig{IDN: test.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, rule := f.Match(test.domain); ok != test.ok {
+			t.Errorf("%s %s: expected %v but got %v (%s)", test.mode, test.domain, test.ok, ok, rule)
+		}
+	}
+
+	if _, err := NewDomainFilter(CertstreamFilterConfig{IDN: "sometimes"}); err == nil {
+		t.Errorf("Expected an error for an unknown idn mode")
+	}
+	if _, err := NewDomainFilter(CertstreamFilterConfig{Include: []string{"("}}); err == nil {
+		t.Errorf("Expected an error for an invalid regex")
+	}
+}
+
+func TestFilterCounters(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	monitor := mon.NewTestSentinelMonitor("certstream-filter-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-filter-test")
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, broker, "zdns", CertstreamConfig{
+		Filter: CertstreamFilterConfig{AllowSuffixes: []string{"valid.domain"}},
+	})
+
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "AA:AA", "01", 1000, `"a.valid.domain", "*.b.valid.domain", "other.domain"`))
+
+	if broker.Depth("zdns") != 2 {
+		t.Errorf("Expected 2 zdns inputs but got %d", broker.Depth("zdns"))
+	}
+	allowed := monitor.Count(mon.CertstreamFilterMatches, "allow_suffix|valid.domain")
+	notAllowed := monitor.Count(mon.CertstreamFilterMatches, "not_allowed")
+	filtered := monitor.Count(mon.CertstreamFiltered)
+	if allowed != 2 || notAllowed != 1 || filtered != 1 {
+		t.Errorf("Expected 2 allowed and 1 filtered but got %d, %d and %d", allowed, notAllowed, filtered)
+	}
+}
@@ -1,15 +1,17 @@
 package certstreamorc
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
-	"time"
+	"sync"
 
-	"github.com/CaliDog/certstream-go"
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
 	db "github.com/gakiwate/sentinel-orchestra/sentinel-db"
 	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
-	"github.com/nsqio/go-nsq"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -18,31 +20,62 @@ import (
 type SentinelCertstreamOrchestrator struct {
 	db          *db.SentinelDB
 	monitor     *mon.SentinelMonitor
-	nsqHost     string
+	broker      sentinelbroker.Broker
 	nsqOutTopic string
+	streamCfg   CertstreamStreamConfig
+	x509Cfg     CertstreamX509Config
+	wildcardCfg CertstreamWildcardConfig
+	filter      *DomainFilter
+	dedupCfg    CertstreamDedupConfig
+	// dedupMu makes reserving a dedup entry atomic, certstream and the CT log
+	// poller schedule concurrently
+	dedupMu sync.Mutex
+	clock   utils.Clock
+}
+
+// CertstreamConfig holds the optional behaviour of the certstream orchestrator
+type CertstreamConfig struct {
+	Stream   CertstreamStreamConfig   `yaml:"stream"`
+	X509     CertstreamX509Config     `yaml:"x509"`
+	Filter   CertstreamFilterConfig   `yaml:"filter"`
+	Dedup    CertstreamDedupConfig    `yaml:"dedup"`
+	Wildcard CertstreamWildcardConfig `yaml:"wildcard"`
 }
 
 // NewSentinelCertstreamOrchestrator creates a new SentinelCertstreamOrchestrator
-func NewSentinelCertstreamOrchestrator(db *db.SentinelDB, monitor *mon.SentinelMonitor, nsqHost string, nsqOutTopic string) *SentinelCertstreamOrchestrator {
+func NewSentinelCertstreamOrchestrator(db *db.SentinelDB, monitor *mon.SentinelMonitor, broker sentinelbroker.Broker, nsqOutTopic string, cfg CertstreamConfig) *SentinelCertstreamOrchestrator {
+	filter, err := NewDomainFilter(cfg.Filter)
+	if err != nil {
+		log.Fatal(err)
+	}
 	return &SentinelCertstreamOrchestrator{
 		db:          db,
 		monitor:     monitor,
-		nsqHost:     nsqHost,
+		broker:      broker,
 		nsqOutTopic: nsqOutTopic,
+		streamCfg:   cfg.Stream.withDefaults(),
+		x509Cfg:     cfg.X509.withDefaults(),
+		wildcardCfg: cfg.Wildcard,
+		filter:      filter,
+		dedupCfg:    cfg.Dedup.withDefaults(),
+		clock:       utils.RealClock{},
 	}
 }
 
+// SetClock replaces the clock used to timestamp scans
+func (o *SentinelCertstreamOrchestrator) SetClock(clock utils.Clock) {
+	o.clock = clock
+}
+
+type SentinelDBResult struct {
+	CertSHA1 string `json:"cert_sha1"`
+}
+
 func formatFQDN(s string) string {
 	// Remove wild card prefixes
 	return strings.TrimPrefix(s, "*.")
 }
 
-func formatSHA1(s string) string {
-	// remove : from the string and make lower case
-	s = strings.ReplaceAll(s, ":", "")
-	return strings.ToLower(s)
-}
-
 func removeDuplicates(strArray []string) []string {
 	strMap := make(map[string]bool)
 	for _, s := range strArray {
@@ -57,88 +90,154 @@ func removeDuplicates(strArray []string) []string {
 	return set
 }
 
-// Run starts the SentinelCertstreamOrchestrator
-func (o *SentinelCertstreamOrchestrator) Run() {
-
-	var nsqHost string = o.nsqHost
-	var nsqOutTopic string = o.nsqOutTopic
+// Run starts the SentinelCertstreamOrchestrator and returns once ctx is done
+func (o *SentinelCertstreamOrchestrator) Run(ctx context.Context) error {
 
 	// Set Logger Level
 	log.SetLevel(log.ErrorLevel)
 
-	// Create a new NSQ producer
-	log.Info("Creating new NSQ producer")
-	nsqUrl := fmt.Sprintf("%s:4150", nsqHost)
-	producer, err := nsq.NewProducer(nsqUrl, nsq.NewConfig())
-	producer.SetLoggerLevel(nsq.LogLevelError)
+	return o.stream(ctx)
+}
+
+// ProcessEvent handles a single certstream message
+func (o *SentinelCertstreamOrchestrator) ProcessEvent(jsonEvent []byte) error {
+	o.monitor.Incr(mon.CertstreamCerts)
+
+	var rawEvent map[string]json.RawMessage
+	err := json.Unmarshal(jsonEvent, &rawEvent)
 	if err != nil {
-		// Report Error and Exit.
-		log.Fatal(err)
+		return err
+	}
+	var event schema.CertstreamEvent
+	err = schema.Unmarshal(jsonEvent, &event)
+	if err != nil {
+		return err
+	}
+	if event.MessageType == "heartbeat" {
+		return nil
+	}
+
+	err = o.broker.Publish("certstream", rawEvent["data"])
+	if err != nil {
+		log.Error(err)
+	}
+
+	// format all domains to remove wildcard entries, remembering which
+	// names were covered by a wildcard
+	domains := []string{}
+	wildcards := make(map[string]bool)
+	for _, domain := range event.Data.LeafCert.AllDomains {
+		fqdn := formatFQDN(domain)
+		if fqdn != domain {
+			wildcards[fqdn] = true
+		}
+		domains = append(domains, fqdn)
 	}
-	log.Info(fmt.Sprintf("Connecting to NSQ at %s", nsqUrl))
-
-	stream, errStream := certstream.CertStreamEventStream(false)
-
-	for {
-		o.monitor.Stats.Incr("monitor|certstream|cert_cnt")
-		select {
-		case jq := <-stream:
-			data, err := jq.Object("data")
-			if err != nil {
-				log.Error(err)
-			}
-			jsonData, err := json.Marshal(data)
-			if err != nil {
-				log.Error(err)
-			}
-			err = producer.Publish("certstream", jsonData)
-			if err != nil {
-				log.Error(err)
-			}
-
-			domains, err := jq.ArrayOfStrings("data", "leaf_cert", "all_domains")
-			// format all domains to remove wildcard entries and lower case
-			for idx, domain := range domains {
-				domains[idx] = formatFQDN(domain)
-			}
-			// remove duplicates. primarily as a result of wild card removals
-			domains = removeDuplicates(domains)
-			if err != nil {
-				log.Error(err)
-			}
-
-			// get cert sha1
-			certSHA1, err := jq.String("data", "leaf_cert", "fingerprint")
-			if err != nil {
-				log.Error(err)
-			}
-			certSHA1 = formatSHA1(certSHA1)
-
-			// get cert type
-			certType, err := jq.String("data", "update_type")
-			if err != nil {
-				log.Error(err)
-			}
-
-			if certType == "PrecertLogEntry" {
-				for _, domain := range domains {
-					o.monitor.Stats.Incr("monitor|certstream|domain_cnt")
-					tnow := time.Now().Unix()
-					dbkey := fmt.Sprintf("certstream|sha1|%s", domain)
-					dbvalue := fmt.Sprintf("{\"cert_sha1\": %s}", certSHA1)
-					o.db.AddResult(dbkey, []byte(dbvalue))
-					zdnsFeedInput := fmt.Sprintf("{\"domain\": \"%s\",\"metadata\": {\"cert_sha1\": \"%s\", \"scan_after\": \"%d\", \"cert_type\": \"%s\"}}", domain, certSHA1, tnow, certType)
-					err = producer.Publish(nsqOutTopic, []byte(zdnsFeedInput))
-					log.Info(fmt.Sprintf("Certstream: Publishing %s to channel %s", zdnsFeedInput, nsqOutTopic))
-					if err != nil {
-						log.Error(err)
-					}
-				}
-			}
-
-		case err := <-errStream:
-			o.monitor.Stats.Incr("monitor|certstream|cert_err_cnt")
+	// remove duplicates. primarily as a result of wild card removals
+	domains = removeDuplicates(domains)
+	// drop domains outside the configured scope
+	domains = o.filterDomains(domains)
+
+	// get cert sha1
+	certSHA1 := utils.FormatSHA1(event.Data.LeafCert.Fingerprint)
+
+	// get cert serial. precerts and their final certs share it
+	certSerial := event.Data.LeafCert.SerialNumber
+
+	// get cert type
+	certType := event.Data.UpdateType
+
+	metadata := schema.NewMetadata(certSHA1, certSerial, certType, o.clock.Now().Unix())
+	metadata.CertIssuer = event.Data.LeafCert.Issuer["aggregated"]
+
+	// keep the certificate if any of its domains is in scope
+	if len(domains) > 0 {
+		o.recordCert(event, certSHA1, domains)
+	}
+
+	switch certType {
+	case "PrecertLogEntry":
+		if o.x509Cfg.Link {
+			o.recordPrecert(event, certSHA1)
+		}
+		for _, domain := range domains {
+			o.scheduleDomain(domain, metadata, wildcards[domain])
+		}
+	case "X509LogEntry":
+		o.processX509(event, metadata, domains, wildcards)
+	}
+	return nil
+}
+
+// filterDomains keeps the domains the filter accepts and counts the rule that
+// decided each one
+func (o *SentinelCertstreamOrchestrator) filterDomains(domains []string) []string {
+	kept := []string{}
+	for _, domain := range domains {
+		ok, rule := o.filter.Match(domain)
+		if rule != "default" {
+			o.monitor.Incr(mon.CertstreamFilterMatches, rule)
+		}
+		if !ok {
+			o.monitor.Incr(mon.CertstreamFiltered)
+			continue
+		}
+		kept = append(kept, domain)
+	}
+	return kept
+}
+
+// scheduleDomain sends a name of the certificate to zdns. Names covered by
+// a wildcard are probed as configured.
+func (o *SentinelCertstreamOrchestrator) scheduleDomain(domain string, metadata schema.Metadata, wildcard bool) {
+	metadata.Wildcard = wildcard
+	o.schedule(domain, metadata)
+	if wildcard {
+		o.probeWildcard(domain, metadata)
+	}
+}
+
+// schedule records the certificate for the domain and sends it to zdns
+func (o *SentinelCertstreamOrchestrator) schedule(domain string, metadata schema.Metadata) {
+	var nsqOutTopic string = o.nsqOutTopic
+
+	// probes are counted under certstream.wildcard_probes
+	if metadata.Probe == "" {
+		o.monitor.Incr(mon.CertstreamDomains)
+	}
+	tnow := metadata.ScanAfterUnix()
+	// probes are not names of the certificate, so scan_unseen does not take
+	// a name only seen as a probe as known
+	if metadata.Probe == "" {
+		dbkey := fmt.Sprintf("certstream|sha1|%s", domain)
+		dbvalue, err := json.Marshal(SentinelDBResult{CertSHA1: metadata.CertSHA1})
+		if err != nil {
+			log.Error(err)
+		} else if err := o.db.AddResult(dbkey, dbvalue); err != nil {
 			log.Error(err)
 		}
 	}
+	random := metadata.Probe == schema.ProbeRandom
+
+	// the domain is already on its way through the zdns stages. Random names
+	// never repeat, probeWildcard reserves the zone instead.
+	if !random && !o.reserve(domain, tnow) {
+		o.monitor.Incr(mon.CertstreamDedupSuppressed)
+		return
+	}
+
+	zdnsFeedInput, err := schema.Marshal(&schema.ZDNSInput{
+		Domain:   domain,
+		Metadata: metadata,
+	})
+	if err == nil {
+		err = o.broker.Publish(nsqOutTopic, zdnsFeedInput)
+		log.Info(fmt.Sprintf("Certstream: Publishing %s to channel %s", zdnsFeedInput, nsqOutTopic))
+	}
+	if err != nil {
+		log.Error(err)
+		if !random {
+			o.unreserve(domain)
+		}
+	}
 }
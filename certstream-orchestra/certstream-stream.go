@@ -0,0 +1,162 @@
+package certstreamorc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCertstreamURL = "wss://certstream.calidog.io"
+	pingPeriod           = 15 * time.Second
+)
+
+// CertstreamStreamConfig controls the connection to the certstream server
+type CertstreamStreamConfig struct {
+	URL            string        `yaml:"url"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+}
+
+func (cfg CertstreamStreamConfig) withDefaults() CertstreamStreamConfig {
+	if cfg.URL == "" {
+		cfg.URL = defaultCertstreamURL
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.InitialBackoff {
+		cfg.MaxBackoff = 5 * time.Minute
+		if cfg.MaxBackoff < cfg.InitialBackoff {
+			cfg.MaxBackoff = cfg.InitialBackoff
+		}
+	}
+	if cfg.ReadTimeout <= 0 {
+		cfg.ReadTimeout = 30 * time.Second
+	}
+	return cfg
+}
+
+// SentinelDBGap records a period during which we were not receiving CT entries
+type SentinelDBGap struct {
+	Start   int64  `json:"start"`
+	End     int64  `json:"end"`
+	Seconds int64  `json:"seconds"`
+	Error   string `json:"error"`
+}
+
+// stream connects to the certstream server and hands every message to
+// ProcessEvent. Lost connections are retried with exponential backoff and
+// the time spent disconnected is recorded once we are back.
+func (o *SentinelCertstreamOrchestrator) stream(ctx context.Context) error {
+	cfg := o.streamCfg
+	backoff := cfg.InitialBackoff
+
+	// time at which the last connection was lost along with its cause
+	var disconnectedAt time.Time
+	var disconnectErr error
+
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, cfg.URL, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			o.monitor.Incr(mon.CertstreamConnectErrors)
+			log.Error(fmt.Sprintf("Certstream: connecting to %s failed, retrying in %s: %v", cfg.URL, backoff, err))
+			if disconnectedAt.IsZero() {
+				disconnectedAt = o.clock.Now()
+				disconnectErr = err
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > cfg.MaxBackoff {
+				backoff = cfg.MaxBackoff
+			}
+			continue
+		}
+
+		log.Info(fmt.Sprintf("Certstream: connected to %s", cfg.URL))
+		o.monitor.Incr(mon.CertstreamConnects)
+		backoff = cfg.InitialBackoff
+		if !disconnectedAt.IsZero() {
+			o.recordGap(disconnectedAt, o.clock.Now(), disconnectErr)
+		}
+
+		err = o.read(ctx, conn)
+		if ctx.Err() != nil {
+			return nil
+		}
+		o.monitor.Incr(mon.CertstreamDisconnects)
+		log.Error(fmt.Sprintf("Certstream: lost connection to %s: %v", cfg.URL, err))
+		disconnectedAt = o.clock.Now()
+		disconnectErr = err
+	}
+}
+
+// read processes messages until the connection fails or ctx is done
+func (o *SentinelCertstreamOrchestrator) read(ctx context.Context, conn *websocket.Conn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingPeriod))
+			case <-ctx.Done():
+				// unblock the reader
+				conn.Close()
+				return
+			case <-done:
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(o.streamCfg.ReadTimeout))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		err = o.ProcessEvent(message)
+		if err != nil {
+			o.monitor.Incr(mon.CertstreamCertErrors)
+			log.Error(err)
+		}
+	}
+}
+
+func (o *SentinelCertstreamOrchestrator) recordGap(start time.Time, end time.Time, cause error) {
+	gap := SentinelDBGap{
+		Start:   start.Unix(),
+		End:     end.Unix(),
+		Seconds: int64(end.Sub(start).Seconds()),
+	}
+	if cause != nil {
+		gap.Error = cause.Error()
+	}
+	o.monitor.Incr(mon.CertstreamGaps)
+	o.monitor.IncrBy(mon.CertstreamGapSeconds, gap.Seconds)
+	log.Error(fmt.Sprintf("Certstream: missed CT entries between %s and %s", start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339)))
+
+	value, err := json.Marshal(gap)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	o.db.AddResult("certstream|gaps", value)
+}
@@ -0,0 +1,101 @@
+package certstreamorc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	db "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	"github.com/gorilla/websocket"
+)
+
+func testEvent(domain string) []byte {
+	return []byte(fmt.Sprintf(`{"message_type": "certificate_update", "data": {"update_type": "PrecertLogEntry", "leaf_cert": {"all_domains": ["%s"], "fingerprint": "AA:BB", "serial_number": "0A"}}}`, domain))
+}
+
+func TestStreamReconnects(t *testing.T) {
+	var mu sync.Mutex
+	connections := 0
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mu.Lock()
+		connections++
+		n := connections
+		mu.Unlock()
+		conn.WriteMessage(websocket.TextMessage, testEvent(fmt.Sprintf("%d.valid.domain", n)))
+		if n == 1 {
+			// drop the first connection right away
+			return
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	monitor := mon.NewTestSentinelMonitor("certstream-stream-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-stream-test")
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, broker, "zdns", CertstreamConfig{
+		Stream: CertstreamStreamConfig{
+			URL:            "ws" + strings.TrimPrefix(server.URL, "http"),
+			InitialBackoff: 10 * time.Millisecond,
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- o.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.Depth("zdns") < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected Run to stop cleanly but got %s", err)
+	}
+
+	if broker.Depth("zdns") != 2 {
+		t.Errorf("Expected a domain from each connection but got %d", broker.Depth("zdns"))
+	}
+	cnt := monitor.Count(mon.CertstreamDisconnects)
+	if cnt != 1 {
+		t.Errorf("Expected 1 disconnect but got %d", cnt)
+	}
+	cnt = monitor.Count(mon.CertstreamGaps)
+	if cnt != 1 {
+		t.Errorf("Expected 1 gap but got %d", cnt)
+	}
+	gaps, _ := sdb.Get("certstream|gaps")
+	if len(gaps) == 0 {
+		t.Errorf("Expected the gap to be recorded")
+	}
+}
+
+func TestStreamBackoff(t *testing.T) {
+	cfg := CertstreamStreamConfig{InitialBackoff: time.Second, MaxBackoff: time.Millisecond}.withDefaults()
+	if cfg.MaxBackoff < cfg.InitialBackoff {
+		t.Errorf("Expected max backoff %s to be at least %s", cfg.MaxBackoff, cfg.InitialBackoff)
+	}
+	if cfg.URL != defaultCertstreamURL {
+		t.Errorf("Expected default url but got %s", cfg.URL)
+	}
+}
@@ -0,0 +1,63 @@
+package certstreamorc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// CertstreamWildcardConfig controls what is scanned for *. entries. The name
+// without the wildcard is always scanned and marked as wildcard in the
+// metadata.
+type CertstreamWildcardConfig struct {
+	// Labels are scanned under every wildcard name, e.g. www.<name> for *.<name>
+	Labels []string `yaml:"labels"`
+	// ProbeRandom resolves a label that should not exist once per dedup
+	// window, so zdns can record whether the zone has DNS wildcarding.
+	// Without a dedup window every certificate of the wildcard is probed.
+	ProbeRandom bool `yaml:"probe_random"`
+}
+
+func randomLabel() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "sentinel-" + hex.EncodeToString(b), nil
+}
+
+// probeWildcard schedules the configured probes under a wildcard name
+func (o *SentinelCertstreamOrchestrator) probeWildcard(domain string, certMetadata schema.Metadata) {
+	tnow := certMetadata.ScanAfterUnix()
+	for _, label := range o.wildcardCfg.Labels {
+		metadata := certMetadata
+		metadata.Wildcard = true
+		metadata.Probe = schema.ProbeLabel
+		o.monitor.Incr(mon.CertstreamWildcardProbes, schema.ProbeLabel)
+		o.schedule(fmt.Sprintf("%s.%s", label, domain), metadata)
+	}
+
+	if !o.wildcardCfg.ProbeRandom {
+		return
+	}
+	// random names never repeat, so dedup on the wildcard itself
+	zone := "*." + domain
+	if !o.reserve(zone, tnow) {
+		return
+	}
+	label, err := randomLabel()
+	if err != nil {
+		log.Error(err)
+		o.unreserve(zone)
+		return
+	}
+	metadata := certMetadata
+	metadata.Wildcard = true
+	metadata.Probe = schema.ProbeRandom
+	o.monitor.Incr(mon.CertstreamWildcardProbes, schema.ProbeRandom)
+	o.schedule(fmt.Sprintf("%s.%s", label, domain), metadata)
+}
@@ -0,0 +1,57 @@
+package certstreamorc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	db "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+)
+
+func TestWildcardProbes(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	monitor := mon.NewTestSentinelMonitor("certstream-wildcard-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-wildcard-test")
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, broker, "zdns", CertstreamConfig{
+		Dedup:    CertstreamDedupConfig{Window: time.Hour},
+		Wildcard: CertstreamWildcardConfig{Labels: []string{"www"}, ProbeRandom: true},
+	})
+	o.SetClock(utils.NewFakeClock(time.Unix(1000, 0)))
+
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "AA:AA", "01", 1000, `"*.b.valid.domain"`))
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "BB:BB", "02", 1000, `"*.b.valid.domain"`))
+
+	// b.valid.domain, www.b.valid.domain and one random probe for the zone
+	if broker.Depth("zdns") != 3 {
+		t.Errorf("Expected 3 zdns inputs but got %d", broker.Depth("zdns"))
+	}
+	if cnt := monitor.Count(mon.CertstreamDomains); cnt != 2 {
+		t.Errorf("Expected only b.valid.domain counted twice as a domain but got %d", cnt)
+	}
+	if cnt := monitor.Count(mon.CertstreamWildcardProbes, schema.ProbeLabel); cnt != 2 {
+		t.Errorf("Expected 2 label probes but got %d", cnt)
+	}
+	if cnt := monitor.Count(mon.CertstreamWildcardProbes, schema.ProbeRandom); cnt != 1 {
+		t.Errorf("Expected 1 random probe but got %d", cnt)
+	}
+
+	keys := []string{}
+	iter := sdb.FetchAllKeysIterator([]byte(dedupPrefix))
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, strings.TrimPrefix(string(iter.Key()), dedupPrefix))
+	}
+	iter.Close()
+	for _, key := range keys {
+		if strings.HasPrefix(key, "sentinel-") {
+			t.Errorf("Expected no dedup entry for the random probe but got %s", key)
+		}
+	}
+	if len(keys) != 3 {
+		t.Errorf("Expected the names and the zone in the dedup store but got %v", keys)
+	}
+}
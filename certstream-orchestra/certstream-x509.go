@@ -0,0 +1,150 @@
+package certstreamorc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// CertstreamX509Config controls how final (X509LogEntry) certificates are used
+type CertstreamX509Config struct {
+	// Link final certificates to their precertificate and record the gap
+	// between the two being logged
+	Link bool `yaml:"link"`
+	// LinkWindow is how long a precertificate waits for its final
+	// certificate before it is swept. Defaults to 24h.
+	LinkWindow time.Duration `yaml:"link_window"`
+	// ScanUnseen sends domains to zdns that never appeared in a precertificate
+	ScanUnseen bool `yaml:"scan_unseen"`
+}
+
+func (cfg CertstreamX509Config) withDefaults() CertstreamX509Config {
+	if cfg.Link && cfg.LinkWindow <= 0 {
+		cfg.LinkWindow = 24 * time.Hour
+	}
+	return cfg
+}
+
+const precertPrefix = "certstream|precert|"
+
+type SentinelDBPrecert struct {
+	CertSHA1 string `json:"cert_sha1"`
+	Seen     int64  `json:"seen"`
+}
+
+type SentinelDBIssuance struct {
+	PrecertSHA1 string `json:"precert_sha1"`
+	CertSHA1    string `json:"cert_sha1"`
+	PrecertSeen int64  `json:"precert_seen"`
+	CertSeen    int64  `json:"cert_seen"`
+	GapSeconds  int64  `json:"gap_seconds"`
+}
+
+// precertKey identifies a certificate by issuer and serial, which a
+// precertificate shares with the final certificate issued for it
+func precertKey(cert schema.CertstreamCert) string {
+	serial := strings.ToUpper(strings.ReplaceAll(cert.SerialNumber, ":", ""))
+	serial = strings.TrimLeft(serial, "0")
+	return fmt.Sprintf("%s%s|%s", precertPrefix, cert.Issuer["aggregated"], serial)
+}
+
+func (o *SentinelCertstreamOrchestrator) eventSeen(event schema.CertstreamEvent) int64 {
+	if event.Data.Seen > 0 {
+		return int64(event.Data.Seen)
+	}
+	return o.clock.Now().Unix()
+}
+
+func (o *SentinelCertstreamOrchestrator) recordPrecert(event schema.CertstreamEvent, certSHA1 string) {
+	value, err := json.Marshal(SentinelDBPrecert{
+		CertSHA1: certSHA1,
+		Seen:     o.eventSeen(event),
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := o.db.Set(precertKey(event.Data.LeafCert), value); err != nil {
+		log.Error(err)
+	}
+}
+
+func (o *SentinelCertstreamOrchestrator) processX509(event schema.CertstreamEvent, metadata schema.Metadata, domains []string, wildcards map[string]bool) {
+	o.monitor.Incr(mon.CertstreamX509)
+
+	if o.x509Cfg.Link {
+		o.linkPrecert(event, metadata.CertSHA1)
+	}
+
+	if o.x509Cfg.ScanUnseen {
+		for _, domain := range domains {
+			known, _ := o.db.Get(fmt.Sprintf("certstream|sha1|%s", domain))
+			if len(known) > 0 {
+				continue
+			}
+			o.monitor.Incr(mon.CertstreamX509UnseenDomains)
+			o.scheduleDomain(domain, metadata, wildcards[domain])
+		}
+	}
+}
+
+// linkPrecert records how long after its precertificate a final certificate
+// showed up in CT
+func (o *SentinelCertstreamOrchestrator) linkPrecert(event schema.CertstreamEvent, certSHA1 string) {
+	value, _ := o.db.Get(precertKey(event.Data.LeafCert))
+	if len(value) == 0 {
+		o.monitor.Incr(mon.CertstreamX509Unlinked)
+		return
+	}
+	var precert SentinelDBPrecert
+	if err := json.Unmarshal(bytes.TrimSpace(value), &precert); err != nil {
+		log.Error(err)
+		return
+	}
+	seen := o.eventSeen(event)
+	if seen-precert.Seen > int64(o.x509Cfg.LinkWindow.Seconds()) {
+		// not swept yet, but past the link window
+		o.monitor.Incr(mon.CertstreamX509Unlinked)
+		return
+	}
+	o.monitor.Incr(mon.CertstreamX509Linked)
+
+	issuance, err := json.Marshal(SentinelDBIssuance{
+		PrecertSHA1: precert.CertSHA1,
+		CertSHA1:    certSHA1,
+		PrecertSeen: precert.Seen,
+		CertSeen:    seen,
+		GapSeconds:  seen - precert.Seen,
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	// indexed both ways so either fingerprint finds the pair
+	for _, sha1 := range []string{precert.CertSHA1, certSHA1} {
+		if err := o.db.AddResult(fmt.Sprintf("certstream|issuance|%s", sha1), issuance); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// SweepPrecerts removes precertificates older than the link window and
+// returns how many were removed
+func (o *SentinelCertstreamOrchestrator) SweepPrecerts() int {
+	cutoff := o.clock.Now().Unix() - int64(o.x509Cfg.LinkWindow.Seconds())
+	expired := o.sweep([]byte(precertPrefix), func(value []byte) bool {
+		var precert SentinelDBPrecert
+		if err := json.Unmarshal(bytes.TrimSpace(value), &precert); err != nil {
+			return true
+		}
+		return precert.Seen <= cutoff
+	})
+	o.monitor.IncrBy(mon.CertstreamPrecertsExpired, int64(expired))
+	return expired
+}
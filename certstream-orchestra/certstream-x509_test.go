@@ -0,0 +1,119 @@
+package certstreamorc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	db "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+)
+
+func testCertEvent(updateType string, fingerprint string, serial string, seen int, domains string) []byte {
+	return []byte(fmt.Sprintf(`{"message_type": "certificate_update", "data": {"update_type": "%s", "seen": %d,
+		"leaf_cert": {"all_domains": [%s], "fingerprint": "%s", "serial_number": "%s", "issuer": {"aggregated": "/C=US/O=Let's Encrypt/CN=R3"}}}}`,
+		updateType, seen, domains, fingerprint, serial))
+}
+
+func TestX509Linking(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	monitor := mon.NewTestSentinelMonitor("certstream-x509-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-x509-test")
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, broker, "zdns", CertstreamConfig{
+		X509: CertstreamX509Config{Link: true, ScanUnseen: true},
+	})
+
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "AA:AA", "0A1B2C", 1000, `"a.valid.domain"`))
+	o.ProcessEvent(testCertEvent("X509LogEntry", "BB:BB", "000A1B2C", 1600, `"a.valid.domain", "new.valid.domain"`))
+	o.ProcessEvent(testCertEvent("X509LogEntry", "CC:CC", "FFFF", 1700, `"a.valid.domain"`))
+
+	value, _ := sdb.Get("certstream|issuance|bbbb")
+	var issuance SentinelDBIssuance
+	if err := json.Unmarshal(bytes.TrimSpace(value), &issuance); err != nil {
+		t.Fatalf("Unable to read issuance %s: %s", value, err)
+	}
+	if issuance.PrecertSHA1 != "aaaa" || issuance.GapSeconds != 600 {
+		t.Errorf("Expected precert aaaa issued 600s earlier but got %+v", issuance)
+	}
+	linked := monitor.Count(mon.CertstreamX509Linked)
+	unlinked := monitor.Count(mon.CertstreamX509Unlinked)
+	if linked != 1 || unlinked != 1 {
+		t.Errorf("Expected 1 linked and 1 unlinked but got %d and %d", linked, unlinked)
+	}
+
+	// a.valid.domain came from the precert, only new.valid.domain is added
+	if broker.Depth("zdns") != 2 {
+		t.Errorf("Expected 2 zdns inputs but got %d", broker.Depth("zdns"))
+	}
+	done := make(chan schema.ZDNSInput, 2)
+	broker.Subscribe("zdns", "test", func(m *sentinelbroker.Message) error {
+		var input schema.ZDNSInput
+		schema.Unmarshal(m.Body, &input)
+		done <- input
+		return nil
+	})
+	first, second := <-done, <-done
+	if first.Domain != "a.valid.domain" || second.Domain != "new.valid.domain" || second.Metadata.CertType != "X509LogEntry" {
+		t.Errorf("Unexpected zdns inputs %+v and %+v", first, second)
+	}
+}
+
+func TestPrecertLinkWindow(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	monitor := mon.NewTestSentinelMonitor("certstream-link-window-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-link-window-test")
+	clock := utils.NewFakeClock(time.Unix(1000, 0))
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, broker, "zdns", CertstreamConfig{
+		X509: CertstreamX509Config{Link: true, LinkWindow: time.Hour},
+	})
+	o.SetClock(clock)
+
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "AA:AA", "01", 1000, `"a.valid.domain"`))
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "BB:BB", "02", 3000, `"b.valid.domain"`))
+	// past the window but not swept yet
+	o.ProcessEvent(testCertEvent("X509LogEntry", "CC:CC", "01", 5000, `"a.valid.domain"`))
+	if unlinked := monitor.Count(mon.CertstreamX509Unlinked); unlinked != 1 {
+		t.Errorf("Expected the final certificate past the window to stay unlinked but got %d", unlinked)
+	}
+
+	clock.Advance(time.Hour)
+	if n := o.SweepPrecerts(); n != 1 {
+		t.Errorf("Expected 1 expired precertificate but got %d", n)
+	}
+	if value, _ := sdb.Get(precertPrefix + "/C=US/O=Let's Encrypt/CN=R3|1"); len(value) != 0 {
+		t.Errorf("Expected the precertificate seen at 1000 to be swept but got %s", value)
+	}
+	o.ProcessEvent(testCertEvent("X509LogEntry", "DD:DD", "02", 4600, `"b.valid.domain"`))
+	if linked := monitor.Count(mon.CertstreamX509Linked); linked != 1 {
+		t.Errorf("Expected the precertificate within the window to link but got %d", linked)
+	}
+}
+
+func TestScanUnseenAfterProbe(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	monitor := mon.NewTestSentinelMonitor("certstream-x509-probe-test-stats")
+	sdb := db.NewTestSentinelDB("certstream-x509-probe-test")
+	o := NewSentinelCertstreamOrchestrator(sdb, monitor, broker, "zdns", CertstreamConfig{
+		X509:     CertstreamX509Config{ScanUnseen: true},
+		Wildcard: CertstreamWildcardConfig{Labels: []string{"www"}},
+	})
+
+	// www.b.valid.domain is only probed under the wildcard of the precert
+	o.ProcessEvent(testCertEvent("PrecertLogEntry", "AA:AA", "01", 1000, `"*.b.valid.domain"`))
+	o.ProcessEvent(testCertEvent("X509LogEntry", "BB:BB", "02", 1100, `"www.b.valid.domain"`))
+
+	if unseen := monitor.Count(mon.CertstreamX509UnseenDomains); unseen != 1 {
+		t.Errorf("Expected www.b.valid.domain to be unseen but got %d unseen domains", unseen)
+	}
+	if value, _ := sdb.Get("certstream|sha1|www.b.valid.domain"); bytes.Count(value, []byte("\n")) != 1 {
+		t.Errorf("Expected only the final certificate for www.b.valid.domain but got %s", value)
+	}
+}
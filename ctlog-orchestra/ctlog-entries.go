@@ -0,0 +1,141 @@
+package ctlogorc
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+)
+
+// RFC 6962 LogEntryType
+const (
+	x509Entry    = 0
+	precertEntry = 1
+)
+
+// CTLogEntry is a single element of a get-entries response
+type CTLogEntry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+type CTLogEntries struct {
+	Entries []CTLogEntry `json:"entries"`
+}
+
+// CTLogSTH is the get-sth response. The signature is not verified.
+type CTLogSTH struct {
+	TreeSize  int64 `json:"tree_size"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+// readASN1Cert reads a certificate prefixed by its 24 bit length
+func readASN1Cert(data []byte) ([]byte, []byte, error) {
+	if len(data) < 3 {
+		return nil, nil, fmt.Errorf("truncated certificate length")
+	}
+	length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	if len(data) < 3+length {
+		return nil, nil, fmt.Errorf("truncated certificate")
+	}
+	return data[3 : 3+length], data[3+length:], nil
+}
+
+// ParseCTLogEntry extracts the logged certificate from a log entry. For
+// precert entries this is the precertificate carried in extra_data, which is
+// also what certstream reports for them.
+func ParseCTLogEntry(entry CTLogEntry) (string, *x509.Certificate, []byte, error) {
+	leaf := entry.LeafInput
+	// version, leaf_type, timestamp, entry_type
+	if len(leaf) < 12 {
+		return "", nil, nil, fmt.Errorf("truncated leaf input")
+	}
+	if leaf[0] != 0 || leaf[1] != 0 {
+		return "", nil, nil, fmt.Errorf("unsupported leaf version %d type %d", leaf[0], leaf[1])
+	}
+
+	var updateType string
+	var der []byte
+	var err error
+	switch binary.BigEndian.Uint16(leaf[10:12]) {
+	case x509Entry:
+		updateType = "X509LogEntry"
+		der, _, err = readASN1Cert(leaf[12:])
+	case precertEntry:
+		updateType = "PrecertLogEntry"
+		der, _, err = readASN1Cert(entry.ExtraData)
+	default:
+		return "", nil, nil, fmt.Errorf("unknown entry type %d", binary.BigEndian.Uint16(leaf[10:12]))
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return updateType, cert, der, nil
+}
+
+func formatFingerprint(der []byte) string {
+	fingerprint := sha1.Sum(der)
+	parts := []string{}
+	for _, b := range fingerprint {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+func formatName(cert *x509.Certificate, issuer bool) map[string]string {
+	if issuer {
+		return utils.NameFields(cert.Issuer)
+	}
+	return utils.NameFields(cert.Subject)
+}
+
+func allDomains(cert *x509.Certificate) []string {
+	domains := []string{}
+	seen := make(map[string]bool)
+	for _, domain := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		if domain == "" || seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// certstreamEvent describes a log entry the way certstream would
+func certstreamEvent(log CTLogConfig, index int64, updateType string, cert *x509.Certificate, der []byte, seen float64) schema.CertstreamEvent {
+	return schema.CertstreamEvent{
+		MessageType: "certificate_update",
+		Data: schema.CertstreamData{
+			UpdateType: updateType,
+			LeafCert: schema.CertstreamCert{
+				AllDomains:         allDomains(cert),
+				Fingerprint:        formatFingerprint(der),
+				SerialNumber:       fmt.Sprintf("%X", cert.SerialNumber),
+				NotBefore:          float64(cert.NotBefore.Unix()),
+				NotAfter:           float64(cert.NotAfter.Unix()),
+				Subject:            formatName(cert, false),
+				Issuer:             formatName(cert, true),
+				SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+				AsDER:              base64.StdEncoding.EncodeToString(der),
+			},
+			CertIndex: index,
+			CertLink:  fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", strings.TrimSuffix(log.URL, "/"), index, index),
+			Seen:      seen,
+			Source: schema.CertstreamSource{
+				Name: log.Name,
+				URL:  log.URL,
+			},
+		},
+	}
+}
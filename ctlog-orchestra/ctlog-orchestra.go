@@ -0,0 +1,193 @@
+package ctlogorc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+	log "github.com/sirupsen/logrus"
+)
+
+type CTLogConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// FromStart fetches the whole log on first start instead of only new entries
+	FromStart bool `yaml:"from_start"`
+}
+
+type CTLogPollerConfig struct {
+	Logs         []CTLogConfig `yaml:"logs"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	BatchSize    int64         `yaml:"batch_size"`
+}
+
+// EventProcessor consumes certstream formatted events. The certstream
+// orchestrator implements it, so both sources feed zdns the same way.
+type EventProcessor interface {
+	ProcessEvent(jsonEvent []byte) error
+}
+
+// SentinelCTLogOrchestrator polls RFC 6962 logs directly
+type SentinelCTLogOrchestrator struct {
+	db        *sentineldb.SentinelDB
+	monitor   *mon.SentinelMonitor
+	processor EventProcessor
+	cfg       CTLogPollerConfig
+	client    *http.Client
+	clock     utils.Clock
+}
+
+func NewSentinelCTLogOrchestrator(db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor, processor EventProcessor, cfg CTLogPollerConfig) *SentinelCTLogOrchestrator {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 10 * time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 256
+	}
+	return &SentinelCTLogOrchestrator{
+		db:        db,
+		monitor:   monitor,
+		processor: processor,
+		cfg:       cfg,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		clock:     utils.RealClock{},
+	}
+}
+
+// SetClock replaces the clock used to timestamp entries
+func (o *SentinelCTLogOrchestrator) SetClock(clock utils.Clock) {
+	o.clock = clock
+}
+
+// Run polls every configured log until ctx is done
+func (o *SentinelCTLogOrchestrator) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, ctlog := range o.cfg.Logs {
+		wg.Add(1)
+		go func(ctlog CTLogConfig) {
+			defer wg.Done()
+			for {
+				if err := o.Poll(ctx, ctlog); err != nil && ctx.Err() == nil {
+					o.monitor.Incr(mon.CTLogErrors, ctlog.Name)
+					log.Error(fmt.Sprintf("CT log %s: %v", ctlog.Name, err))
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(o.cfg.PollInterval):
+				}
+			}
+		}(ctlog)
+	}
+	wg.Wait()
+	return nil
+}
+
+func positionKey(ctlog CTLogConfig) string {
+	return fmt.Sprintf("ctlog|position|%s", ctlog.URL)
+}
+
+// Position returns the index of the next entry to fetch from the log
+func (o *SentinelCTLogOrchestrator) Position(ctlog CTLogConfig) (int64, bool) {
+	value, _ := o.db.Get(positionKey(ctlog))
+	if len(value) == 0 {
+		return 0, false
+	}
+	position, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return position, true
+}
+
+func (o *SentinelCTLogOrchestrator) setPosition(ctlog CTLogConfig, position int64) error {
+	return o.db.Set(positionKey(ctlog), []byte(strconv.FormatInt(position, 10)))
+}
+
+// Poll fetches every entry added to the log since the last poll
+func (o *SentinelCTLogOrchestrator) Poll(ctx context.Context, ctlog CTLogConfig) error {
+	var sth CTLogSTH
+	if err := o.get(ctx, ctlog, "get-sth", &sth); err != nil {
+		return err
+	}
+
+	position, ok := o.Position(ctlog)
+	if !ok {
+		if !ctlog.FromStart {
+			position = sth.TreeSize
+		}
+		if err := o.setPosition(ctlog, position); err != nil {
+			return err
+		}
+	}
+
+	for position < sth.TreeSize {
+		end := position + o.cfg.BatchSize - 1
+		if end >= sth.TreeSize {
+			end = sth.TreeSize - 1
+		}
+		var entries CTLogEntries
+		if err := o.get(ctx, ctlog, fmt.Sprintf("get-entries?start=%d&end=%d", position, end), &entries); err != nil {
+			return err
+		}
+		if len(entries.Entries) == 0 {
+			return fmt.Errorf("no entries returned for %d-%d", position, end)
+		}
+		// logs may return fewer entries than asked for
+		for _, entry := range entries.Entries {
+			o.processEntry(ctlog, position, entry)
+			position++
+		}
+		if err := o.setPosition(ctlog, position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *SentinelCTLogOrchestrator) processEntry(ctlog CTLogConfig, index int64, entry CTLogEntry) {
+	o.monitor.Incr(mon.CTLogEntries, ctlog.Name)
+	updateType, cert, der, err := ParseCTLogEntry(entry)
+	if err != nil {
+		o.monitor.Incr(mon.CTLogParseErrors, ctlog.Name)
+		log.Error(fmt.Sprintf("CT log %s: entry %d: %v", ctlog.Name, index, err))
+		return
+	}
+
+	seen := float64(o.clock.Now().UnixNano()) / 1e9
+	event := certstreamEvent(ctlog, index, updateType, cert, der, seen)
+	jsonEvent, err := schema.Marshal(&event)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := o.processor.ProcessEvent(jsonEvent); err != nil {
+		log.Error(err)
+	}
+}
+
+func (o *SentinelCTLogOrchestrator) get(ctx context.Context, ctlog CTLogConfig, path string, v interface{}) error {
+	url := fmt.Sprintf("%s/ct/v1/%s", strings.TrimSuffix(ctlog.URL, "/"), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
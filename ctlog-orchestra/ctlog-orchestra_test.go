@@ -0,0 +1,208 @@
+package ctlogorc
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	certstreamorc "github.com/gakiwate/sentinel-orchestra/certstream-orchestra"
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	testutils "github.com/gakiwate/sentinel-orchestra/sentinel-testutils"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+)
+
+type recordingProcessor struct {
+	mu     sync.Mutex
+	events []schema.CertstreamEvent
+}
+
+func (p *recordingProcessor) ProcessEvent(jsonEvent []byte) error {
+	var event schema.CertstreamEvent
+	if err := schema.Unmarshal(jsonEvent, &event); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+func testCertificate(t *testing.T, domain string, serial int64, precert bool) []byte {
+	return testutils.Certificate(t, testutils.TestCert{Serial: serial, Domains: []string{domain, "www." + domain}, Precert: precert})
+}
+
+func asn1Cert(der []byte) []byte {
+	return append([]byte{byte(len(der) >> 16), byte(len(der) >> 8), byte(len(der))}, der...)
+}
+
+func testEntry(entryType uint16, der []byte) CTLogEntry {
+	// version, leaf_type, timestamp, entry_type
+	leaf := make([]byte, 12)
+	binary.BigEndian.PutUint64(leaf[2:10], 1677664800000)
+	binary.BigEndian.PutUint16(leaf[10:12], entryType)
+	entry := CTLogEntry{}
+	if entryType == x509Entry {
+		entry.LeafInput = append(leaf, asn1Cert(der)...)
+	} else {
+		// the leaf holds the TBSCertificate, the precert itself is in extra_data
+		entry.LeafInput = append(append(leaf, make([]byte, 32)...), asn1Cert([]byte{0x30, 0x00})...)
+		entry.ExtraData = append(asn1Cert(der), 0, 0, 0)
+	}
+	return entry
+}
+
+// testLog serves get-sth and get-entries for a fixed set of entries and
+// never returns more than two entries at once
+func testLog(entries *[]CTLogEntry) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ct/v1/get-sth", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(CTLogSTH{TreeSize: int64(len(*entries)), Timestamp: 1677664800000})
+	})
+	mux.HandleFunc("/ct/v1/get-entries", func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		end, _ := strconv.Atoi(r.URL.Query().Get("end"))
+		if end > start+1 {
+			end = start + 1
+		}
+		json.NewEncoder(w).Encode(CTLogEntries{Entries: (*entries)[start : end+1]})
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestPollEntries(t *testing.T) {
+	entries := []CTLogEntry{
+		testEntry(x509Entry, testCertificate(t, "x.valid.domain", 1, false)),
+		testEntry(precertEntry, testCertificate(t, "p.valid.domain", 0x0A1B, true)),
+		{LeafInput: []byte{0, 0, 1}},
+	}
+	server := testLog(&entries)
+	defer server.Close()
+
+	db := sentineldb.NewTestSentinelDB("ctlog-test")
+	monitor := mon.NewTestSentinelMonitor("ctlog-test-stats")
+	processor := &recordingProcessor{}
+	ctlog := CTLogConfig{Name: "test", URL: server.URL + "/", FromStart: true}
+	o := NewSentinelCTLogOrchestrator(db, monitor, processor, CTLogPollerConfig{Logs: []CTLogConfig{ctlog}, BatchSize: 10})
+
+	if err := o.Poll(context.Background(), ctlog); err != nil {
+		t.Fatalf("Unable to poll: %s", err)
+	}
+	if len(processor.events) != 2 {
+		t.Fatalf("Expected 2 events but got %d", len(processor.events))
+	}
+	x509Event := processor.events[0].Data
+	if x509Event.UpdateType != "X509LogEntry" || x509Event.LeafCert.AllDomains[0] != "x.valid.domain" || len(x509Event.LeafCert.AllDomains) != 2 {
+		t.Errorf("Unexpected x509 event %+v", x509Event)
+	}
+	precertEvent := processor.events[1].Data
+	if precertEvent.UpdateType != "PrecertLogEntry" || precertEvent.LeafCert.SerialNumber != "A1B" || precertEvent.CertIndex != 1 {
+		t.Errorf("Unexpected precert event %+v", precertEvent)
+	}
+	if len(precertEvent.LeafCert.Fingerprint) != 59 {
+		t.Errorf("Expected a colon separated sha1 fingerprint but got %s", precertEvent.LeafCert.Fingerprint)
+	}
+	cnt := monitor.Count(mon.CTLogParseErrors, "test")
+	if cnt != 1 {
+		t.Errorf("Expected 1 parse error but got %d", cnt)
+	}
+
+	// a restarted poller resumes where the previous one stopped
+	entries = append(entries, testEntry(x509Entry, testCertificate(t, "y.valid.domain", 2, false)))
+	processor = &recordingProcessor{}
+	o = NewSentinelCTLogOrchestrator(db, monitor, processor, CTLogPollerConfig{Logs: []CTLogConfig{ctlog}})
+	if err := o.Poll(context.Background(), ctlog); err != nil {
+		t.Fatalf("Unable to poll: %s", err)
+	}
+	if len(processor.events) != 1 || processor.events[0].Data.LeafCert.AllDomains[0] != "y.valid.domain" {
+		t.Errorf("Expected only the new entry but got %+v", processor.events)
+	}
+	position, _ := o.Position(ctlog)
+	if position != 4 {
+		t.Errorf("Expected position 4 but got %d", position)
+	}
+}
+
+func TestPollStartsAtHead(t *testing.T) {
+	entries := []CTLogEntry{testEntry(x509Entry, testCertificate(t, "x.valid.domain", 1, false))}
+	server := testLog(&entries)
+	defer server.Close()
+
+	db := sentineldb.NewTestSentinelDB("ctlog-head-test")
+	monitor := mon.NewTestSentinelMonitor("ctlog-head-test-stats")
+	processor := &recordingProcessor{}
+	ctlog := CTLogConfig{Name: "test", URL: server.URL}
+	o := NewSentinelCTLogOrchestrator(db, monitor, processor, CTLogPollerConfig{Logs: []CTLogConfig{ctlog}})
+	if err := o.Poll(context.Background(), ctlog); err != nil {
+		t.Fatalf("Unable to poll: %s", err)
+	}
+	if len(processor.events) != 0 {
+		t.Errorf("Expected existing entries to be skipped but got %d", len(processor.events))
+	}
+	position, ok := o.Position(ctlog)
+	if !ok || position != 1 {
+		t.Errorf("Expected position 1 but got %d", position)
+	}
+}
+
+func TestFormatName(t *testing.T) {
+	der := testutils.Certificate(t, testutils.TestCert{
+		Serial:  1,
+		Domains: []string{"x.valid.domain"},
+		Issuer:  testutils.R3,
+	})
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := formatName(cert, true)
+	if issuer["aggregated"] != "/C=US/O=Let's Encrypt/CN=R3" || issuer["O"] != "Let's Encrypt" {
+		t.Errorf("Expected the certstream form of the issuer but got %v", issuer)
+	}
+}
+
+// A precertificate seen on certstream links to its final certificate read
+// from a CT log
+func TestLinkAcrossSources(t *testing.T) {
+	entries := []CTLogEntry{testEntry(x509Entry, testutils.Certificate(t, testutils.TestCert{
+		Serial:  0x0A1B2C,
+		Domains: []string{"a.valid.domain"},
+		Issuer:  testutils.R3,
+	}))}
+	server := testLog(&entries)
+	defer server.Close()
+
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	db := sentineldb.NewTestSentinelDB("ctlog-link-test")
+	monitor := mon.NewTestSentinelMonitor("ctlog-link-test-stats")
+	certstream := certstreamorc.NewSentinelCertstreamOrchestrator(db, monitor, broker, "zdns", certstreamorc.CertstreamConfig{
+		X509: certstreamorc.CertstreamX509Config{Link: true},
+	})
+	precert := `{"message_type": "certificate_update", "data": {"update_type": "PrecertLogEntry", "seen": 1677664000,
+		"leaf_cert": {"all_domains": ["a.valid.domain"], "fingerprint": "AA:AA", "serial_number": "0A1B2C",
+		"issuer": {"aggregated": "/C=US/O=Let's Encrypt/CN=R3", "C": "US", "O": "Let's Encrypt", "CN": "R3"}}}}`
+	if err := certstream.ProcessEvent([]byte(precert)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctlog := CTLogConfig{Name: "test", URL: server.URL, FromStart: true}
+	o := NewSentinelCTLogOrchestrator(db, monitor, certstream, CTLogPollerConfig{Logs: []CTLogConfig{ctlog}})
+	// the final certificate shows up within the link window
+	o.SetClock(utils.NewFakeClock(time.Unix(1677664800, 0)))
+	if err := o.Poll(context.Background(), ctlog); err != nil {
+		t.Fatalf("Unable to poll: %s", err)
+	}
+	if linked := monitor.Count(mon.CertstreamX509Linked); linked != 1 {
+		t.Errorf("Expected the final certificate to link to the certstream precert but got %d links", linked)
+	}
+}
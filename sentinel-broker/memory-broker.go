@@ -0,0 +1,166 @@
+package sentinelbroker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type memoryChannel struct {
+	queue []*Message
+}
+
+// MemoryBroker is an in-process Broker following the NSQ delivery model:
+// every channel of a topic receives a copy of each message, subscribers of
+// a channel share its messages, and messages published before any channel
+// exists are held on the topic.
+type MemoryBroker struct {
+	// RequeueDelay is how long a handler backs off after returning an error
+	RequeueDelay time.Duration
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	topics   map[string]map[string]*memoryChannel
+	backlog  map[string][]*Message
+	inFlight int
+	stopped  bool
+	wg       sync.WaitGroup
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		RequeueDelay: 100 * time.Millisecond,
+		topics:       make(map[string]map[string]*memoryChannel),
+		backlog:      make(map[string][]*Message),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *MemoryBroker) Publish(topic string, body []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return fmt.Errorf("broker stopped")
+	}
+
+	channels := b.topics[topic]
+	if len(channels) == 0 {
+		b.backlog[topic] = append(b.backlog[topic], newMemoryMessage(topic, body))
+		return nil
+	}
+	for _, channel := range channels {
+		channel.queue = append(channel.queue, newMemoryMessage(topic, body))
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+func newMemoryMessage(topic string, body []byte) *Message {
+	m := &Message{Topic: topic, Body: make([]byte, len(body))}
+	copy(m.Body, body)
+	return m
+}
+
+func (b *MemoryBroker) Subscribe(topic string, channel string, handler Handler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return fmt.Errorf("broker stopped")
+	}
+
+	channels, ok := b.topics[topic]
+	if !ok {
+		channels = make(map[string]*memoryChannel)
+		b.topics[topic] = channels
+	}
+	c, ok := channels[channel]
+	if !ok {
+		c = &memoryChannel{}
+		channels[channel] = c
+		// the first channel of a topic receives what was held on the topic
+		if len(channels) == 1 {
+			c.queue = b.backlog[topic]
+			delete(b.backlog, topic)
+		}
+	}
+
+	b.wg.Add(1)
+	go b.deliver(c, handler)
+	return nil
+}
+
+func (b *MemoryBroker) deliver(c *memoryChannel, handler Handler) {
+	defer b.wg.Done()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		for len(c.queue) == 0 && !b.stopped {
+			b.cond.Wait()
+		}
+		if b.stopped {
+			return
+		}
+		m := c.queue[0]
+		c.queue = c.queue[1:]
+		m.Attempts++
+		b.inFlight++
+		b.mu.Unlock()
+
+		err := handler(m)
+		if err != nil && b.RequeueDelay > 0 {
+			time.Sleep(b.RequeueDelay)
+		}
+
+		b.mu.Lock()
+		if err != nil {
+			c.queue = append(c.queue, m)
+		}
+		b.inFlight--
+		b.cond.Broadcast()
+	}
+}
+
+// Depth returns the number of messages waiting on topic
+func (b *MemoryBroker) Depth(topic string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	depth := len(b.backlog[topic])
+	for _, c := range b.topics[topic] {
+		depth += len(c.queue)
+	}
+	return depth
+}
+
+// TopicDepth returns Depth for DepthBroker
+func (b *MemoryBroker) TopicDepth(topic string) (int64, error) {
+	return int64(b.Depth(topic)), nil
+}
+
+// WaitIdle blocks until no subscribed channel has queued or in-flight messages
+func (b *MemoryBroker) WaitIdle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.stopped && (b.inFlight > 0 || b.queued()) {
+		b.cond.Wait()
+	}
+}
+
+func (b *MemoryBroker) queued() bool {
+	for _, channels := range b.topics {
+		for _, c := range channels {
+			if len(c.queue) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *MemoryBroker) Stop() {
+	b.mu.Lock()
+	b.stopped = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	b.wg.Wait()
+}
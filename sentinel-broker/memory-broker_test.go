@@ -0,0 +1,83 @@
+package sentinelbroker
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func InitTest(t *testing.T) *MemoryBroker {
+	b := NewMemoryBroker()
+	b.RequeueDelay = 0
+	t.Cleanup(b.Stop)
+	return b
+}
+
+type received struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *received) handler(m *Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, string(m.Body))
+	return nil
+}
+
+func TestChannelsReceiveCopies(t *testing.T) {
+	b := InitTest(t)
+	first, second := &received{}, &received{}
+	b.Subscribe("zdns", "orchestrator", first.handler)
+	b.Subscribe("zdns", "archive", second.handler)
+	b.Publish("zdns", []byte("www.valid.domain"))
+	b.WaitIdle()
+	if len(first.messages) != 1 || len(second.messages) != 1 {
+		t.Errorf("Expected one message per channel but got %d and %d", len(first.messages), len(second.messages))
+	}
+}
+
+func TestSubscribersShareChannel(t *testing.T) {
+	b := InitTest(t)
+	shared := &received{}
+	b.Subscribe("zdns", "orchestrator", shared.handler)
+	b.Subscribe("zdns", "orchestrator", shared.handler)
+	for i := 0; i < 10; i++ {
+		b.Publish("zdns", []byte(fmt.Sprintf("%d.valid.domain", i)))
+	}
+	b.WaitIdle()
+	if len(shared.messages) != 10 {
+		t.Errorf("Expected 10 messages but got %d", len(shared.messages))
+	}
+}
+
+func TestTopicHoldsMessages(t *testing.T) {
+	b := InitTest(t)
+	b.Publish("zdns", []byte("www.valid.domain"))
+	if b.Depth("zdns") != 1 {
+		t.Errorf("Expected depth 1 but got %d", b.Depth("zdns"))
+	}
+	late := &received{}
+	b.Subscribe("zdns", "orchestrator", late.handler)
+	b.WaitIdle()
+	if len(late.messages) != 1 {
+		t.Errorf("Expected held message to be delivered but got %d", len(late.messages))
+	}
+}
+
+func TestRequeueOnError(t *testing.T) {
+	b := InitTest(t)
+	var attempts uint16
+	b.Subscribe("zdns", "orchestrator", func(m *Message) error {
+		attempts = m.Attempts
+		if m.Attempts < 3 {
+			return fmt.Errorf("attempt %d failed", m.Attempts)
+		}
+		return nil
+	})
+	b.Publish("zdns", []byte("www.valid.domain"))
+	b.WaitIdle()
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts but got %d", attempts)
+	}
+}
@@ -0,0 +1,143 @@
+package sentinelbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+type NSQBrokerConfig struct {
+	Host        string
+	NSQDPort    int
+	LookupdPort int
+	// NSQDHTTPPort serves the nsqd stats the topic depths are read from
+	NSQDHTTPPort int
+	// MaxAttempts is how often a message is delivered before nsq drops it,
+	// 0 keeps the nsq default
+	MaxAttempts uint16
+}
+
+// NSQBroker publishes to nsqd and discovers consumers through nsqlookupd
+type NSQBroker struct {
+	cfg       NSQBrokerConfig
+	producer  *nsq.Producer
+	mu        sync.Mutex
+	consumers []*nsq.Consumer
+}
+
+func NewNSQBroker(cfg NSQBrokerConfig) (*NSQBroker, error) {
+	if cfg.NSQDPort == 0 {
+		cfg.NSQDPort = 4150
+	}
+	if cfg.LookupdPort == 0 {
+		cfg.LookupdPort = 4161
+	}
+	if cfg.NSQDHTTPPort == 0 {
+		cfg.NSQDHTTPPort = 4151
+	}
+	nsqUrl := fmt.Sprintf("%s:%d", cfg.Host, cfg.NSQDPort)
+	producer, err := nsq.NewProducer(nsqUrl, nsq.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	producer.SetLoggerLevel(nsq.LogLevelError)
+	return &NSQBroker{
+		cfg:      cfg,
+		producer: producer,
+	}, nil
+}
+
+func (b *NSQBroker) Publish(topic string, body []byte) error {
+	return b.producer.Publish(topic, body)
+}
+
+func (b *NSQBroker) Subscribe(topic string, channel string, handler Handler) error {
+	config := nsq.NewConfig()
+	if b.cfg.MaxAttempts > 0 {
+		config.MaxAttempts = b.cfg.MaxAttempts
+	}
+	consumer, err := nsq.NewConsumer(topic, channel, config)
+	if err != nil {
+		return err
+	}
+	consumer.SetLoggerLevel(nsq.LogLevelError)
+	consumer.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
+		return handler(&Message{
+			Topic:    topic,
+			Body:     m.Body,
+			Attempts: m.Attempts,
+		})
+	}))
+
+	// Use nsqlookupd to discover nsqd instances.
+	nsqUrl := fmt.Sprintf("%s:%d", b.cfg.Host, b.cfg.LookupdPort)
+	if err := consumer.ConnectToNSQLookupd(nsqUrl); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.consumers = append(b.consumers, consumer)
+	b.mu.Unlock()
+	return nil
+}
+
+// nsqdStats is the part of the nsqd /stats response holding the depths
+type nsqdStats struct {
+	Topics []struct {
+		Name     string `json:"topic_name"`
+		Depth    int64  `json:"depth"`
+		Channels []struct {
+			Depth int64 `json:"depth"`
+		} `json:"channels"`
+	} `json:"topics"`
+}
+
+// TopicDepth asks nsqd how many messages wait on topic and its channels
+func (b *NSQBroker) TopicDepth(topic string) (int64, error) {
+	statsUrl := fmt.Sprintf("http://%s:%d/stats?format=json&topic=%s", b.cfg.Host, b.cfg.NSQDHTTPPort, url.QueryEscape(topic))
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(statsUrl)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("nsqd stats: %s", resp.Status)
+	}
+	var stats nsqdStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return 0, err
+	}
+	var depth int64
+	for _, t := range stats.Topics {
+		if t.Name != topic {
+			continue
+		}
+		depth += t.Depth
+		for _, c := range t.Channels {
+			depth += c.Depth
+		}
+	}
+	return depth, nil
+}
+
+func (b *NSQBroker) Stop() {
+	b.mu.Lock()
+	consumers := b.consumers
+	b.consumers = nil
+	b.mu.Unlock()
+
+	// Gracefully stop the consumers before the producer they may publish on
+	for _, consumer := range consumers {
+		consumer.Stop()
+	}
+	for _, consumer := range consumers {
+		<-consumer.StopChan
+	}
+	b.producer.Stop()
+}
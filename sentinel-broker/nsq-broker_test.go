@@ -0,0 +1,32 @@
+package sentinelbroker
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestNSQTopicDepth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("topic") != "zdns" {
+			t.Errorf("Expected the zdns topic to be requested but got %s", r.URL)
+		}
+		w.Write([]byte(`{"version": "1.2.1", "topics": [{"topic_name": "zdns", "depth": 2,
+			"channels": [{"channel_name": "zdns", "depth": 3}, {"channel_name": "archive", "depth": 1}]}]}`))
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	httpPort, _ := strconv.Atoi(port)
+
+	b, err := NewNSQBroker(NSQBrokerConfig{Host: host, NSQDHTTPPort: httpPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	depth, err := b.TopicDepth("zdns")
+	if err != nil || depth != 6 {
+		t.Errorf("Expected depth 6 but got %d (%v)", depth, err)
+	}
+}
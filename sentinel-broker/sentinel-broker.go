@@ -0,0 +1,29 @@
+package sentinelbroker
+
+// Message is a single message delivered to a Handler
+type Message struct {
+	Topic    string
+	Body     []byte
+	Attempts uint16
+}
+
+// Handler processes a message. Returning an error requeues the message.
+type Handler func(m *Message) error
+
+// Broker moves messages between the orchestrators and the scan workers
+type Broker interface {
+	// Publish sends body to every channel subscribed to topic
+	Publish(topic string, body []byte) error
+	// Subscribe delivers the messages of topic to handler. Subscribers sharing
+	// a channel split the messages between them.
+	Subscribe(topic string, channel string, handler Handler) error
+	// Stop waits for in-flight messages and releases the broker
+	Stop()
+}
+
+// DepthBroker is a Broker that can tell how many messages wait on a topic
+type DepthBroker interface {
+	Broker
+	// TopicDepth counts the messages held on topic and its channels
+	TopicDepth(topic string) (int64, error)
+}
@@ -0,0 +1,82 @@
+package sentineldb
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ChainGrace is how long past its scheduled scan a (domain, ip) pair still
+// counts as being in a rescan chain. It covers the time the worker takes to
+// answer, and lets pairs whose result got lost be grabbed again.
+const ChainGrace = time.Hour
+
+const chainPrefix = "zgrab|chain|"
+
+func chainKey(domain string, ip string) string {
+	return fmt.Sprintf("%s%s|%s", chainPrefix, domain, ip)
+}
+
+// MarkChain records that the pair has a grab scheduled at scanAfter. A
+// chain scheduled further out is kept, so an older chain cannot shorten it.
+func (db *SentinelDB) MarkChain(domain string, ip string, scanAfter int64) error {
+	db.chainMu.Lock()
+	defer db.chainMu.Unlock()
+	expires := scanAfter + int64(ChainGrace.Seconds())
+	if stored, ok := db.chainExpiry(domain, ip); ok && stored >= expires {
+		return nil
+	}
+	return db.Set(chainKey(domain, ip), []byte(strconv.FormatInt(expires, 10)))
+}
+
+// EndChain records that the last stage grabbed the pair at scanAfter. The
+// entry is only removed while it still belongs to that grab, a newer chain
+// marked since then keeps it.
+func (db *SentinelDB) EndChain(domain string, ip string, scanAfter int64) error {
+	db.chainMu.Lock()
+	defer db.chainMu.Unlock()
+	if stored, ok := db.chainExpiry(domain, ip); !ok || stored != scanAfter+int64(ChainGrace.Seconds()) {
+		return nil
+	}
+	return db.Delete(chainKey(domain, ip))
+}
+
+func (db *SentinelDB) chainExpiry(domain string, ip string) (int64, bool) {
+	value, _ := db.Get(chainKey(domain, ip))
+	if len(value) == 0 {
+		return 0, false
+	}
+	expires, err := strconv.ParseInt(string(value), 10, 64)
+	return expires, err == nil
+}
+
+// InChain reports whether a grab of the pair is scheduled at now
+func (db *SentinelDB) InChain(domain string, ip string, now int64) bool {
+	expires, ok := db.chainExpiry(domain, ip)
+	return ok && expires > now
+}
+
+// SweepChains removes the pairs whose chain expired by now, such as those
+// whose last grab never answered, and returns how many were removed
+func (db *SentinelDB) SweepChains(now int64) (int, error) {
+	db.chainMu.Lock()
+	defer db.chainMu.Unlock()
+	keys := []string{}
+	iter := db.FetchAllKeysIterator([]byte(chainPrefix))
+	for iter.First(); iter.Valid(); iter.Next() {
+		expires, err := strconv.ParseInt(string(iter.Value()), 10, 64)
+		if err != nil || expires <= now {
+			keys = append(keys, string(iter.Key()))
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+
+	for idx, key := range keys {
+		if err := db.Delete(key); err != nil {
+			return idx, err
+		}
+	}
+	return len(keys), nil
+}
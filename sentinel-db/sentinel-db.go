@@ -2,6 +2,7 @@ package sentineldb
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/cockroachdb/pebble"
 	sentinelstore "github.com/gakiwate/sentinel-orchestra/sentinel-store"
@@ -10,6 +11,8 @@ import (
 type SentinelDB struct {
 	store     sentinelstore.SentinelStore
 	StoreName string
+	// chainMu serializes the read-modify-write of rescan chain entries
+	chainMu sync.Mutex
 }
 
 // New Instance of SentinelDB
@@ -51,11 +54,27 @@ func (db *SentinelDB) AddResult(key string, resultJSON []byte) error {
 	return batch.Commit(pebble.Sync)
 }
 
+// Set replaces the value associated with the key
+func (db *SentinelDB) Set(key string, value []byte) error {
+	return db.store.DB.Set([]byte(key), value, pebble.Sync)
+}
+
 func (db *SentinelDB) Get(key string) ([]byte, error) {
 	value, ioc, err := db.store.DB.Get([]byte(key))
 	if err != nil {
 		return []byte{}, nil
 	}
 	defer ioc.Close()
-	return value, err
+	// value is only valid until the closer is closed
+	return append([]byte{}, value...), err
+}
+
+// Delete removes the key
+func (db *SentinelDB) Delete(key string) error {
+	return db.store.DB.Delete([]byte(key), pebble.Sync)
+}
+
+// FetchAllKeysIterator iterates over every key starting with keyPrefix
+func (db *SentinelDB) FetchAllKeysIterator(keyPrefix []byte) *pebble.Iterator {
+	return db.store.DB.NewIter(sentinelstore.PrefixIterOptions(keyPrefix))
 }
@@ -49,3 +49,78 @@ func TestAddResult1(t *testing.T) {
 	}
 
 }
+
+func TestSet(t *testing.T) {
+	db := InitTest(t)
+	key := "www.valid.domain"
+	db.AddResult(key, []byte("1"))
+	err := db.Set(key, []byte("2"))
+	if err != nil {
+		t.Error("Unable to set key")
+	}
+	data, _ := db.Get(key)
+	if !bytes.Equal(data, []byte("2")) {
+		t.Errorf("Expected 2 but instead got %s", data)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := InitTest(t)
+	db.Set("seen|a", []byte("1"))
+	db.Set("seen|b", []byte("2"))
+	db.Set("other", []byte("3"))
+	if err := db.Delete("seen|a"); err != nil {
+		t.Error("Unable to delete key")
+	}
+
+	keys := []string{}
+	iter := db.FetchAllKeysIterator([]byte("seen|"))
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	if len(keys) != 1 || keys[0] != "seen|b" {
+		t.Errorf("Expected only seen|b but got %v", keys)
+	}
+}
+
+func TestSweepChains(t *testing.T) {
+	db := InitTest(t)
+	db.MarkChain("a.valid.domain", "192.0.2.1", 1000)
+	db.MarkChain("b.valid.domain", "192.0.2.2", 5000)
+	db.MarkChain("c.valid.domain", "192.0.2.3", 1000)
+	db.EndChain("c.valid.domain", "192.0.2.3", 1000)
+
+	now := int64(2000) + int64(ChainGrace.Seconds())
+	if !db.InChain("b.valid.domain", "192.0.2.2", now) || db.InChain("a.valid.domain", "192.0.2.1", now) {
+		t.Errorf("Expected only b.valid.domain to be in a chain")
+	}
+	expired, err := db.SweepChains(now)
+	if err != nil || expired != 1 {
+		t.Errorf("Expected 1 expired entry but got %d (%v)", expired, err)
+	}
+	if value, _ := db.Get(chainKey("a.valid.domain", "192.0.2.1")); len(value) != 0 {
+		t.Errorf("Expected a.valid.domain to be swept but got %s", value)
+	}
+	if !db.InChain("b.valid.domain", "192.0.2.2", now) {
+		t.Errorf("Expected b.valid.domain to still be in a chain")
+	}
+}
+
+func TestChainOwnership(t *testing.T) {
+	db := InitTest(t)
+	// a new chain at 5000 starts while the old one scheduled at 1000 ends
+	db.MarkChain("a.valid.domain", "192.0.2.1", 1000)
+	db.MarkChain("a.valid.domain", "192.0.2.1", 5000)
+	db.MarkChain("a.valid.domain", "192.0.2.1", 1000)
+	if err := db.EndChain("a.valid.domain", "192.0.2.1", 1000); err != nil {
+		t.Fatalf("Unable to end chain: %s", err)
+	}
+	if !db.InChain("a.valid.domain", "192.0.2.1", 5000) {
+		t.Errorf("Expected the chain scheduled at 5000 to survive the older one")
+	}
+	db.EndChain("a.valid.domain", "192.0.2.1", 5000)
+	if db.InChain("a.valid.domain", "192.0.2.1", 5000) {
+		t.Errorf("Expected the chain to end with its last grab")
+	}
+}
@@ -0,0 +1,308 @@
+package sentinelharness
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	certstreamorc "github.com/gakiwate/sentinel-orchestra/certstream-orchestra"
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+	zdnsorc "github.com/gakiwate/sentinel-orchestra/zdns-orchestra"
+	zgraborc "github.com/gakiwate/sentinel-orchestra/zgrab-orchestra"
+)
+
+// RecordingBroker keeps a copy of everything published through it
+type RecordingBroker struct {
+	sentinelbroker.Broker
+	mu        sync.Mutex
+	published map[string][][]byte
+}
+
+func NewRecordingBroker(broker sentinelbroker.Broker) *RecordingBroker {
+	return &RecordingBroker{
+		Broker:    broker,
+		published: make(map[string][][]byte),
+	}
+}
+
+func (b *RecordingBroker) Publish(topic string, body []byte) error {
+	b.mu.Lock()
+	b.published[topic] = append(b.published[topic], append([]byte{}, body...))
+	b.mu.Unlock()
+	return b.Broker.Publish(topic, body)
+}
+
+// Published returns the messages published on topic so far
+func (b *RecordingBroker) Published(topic string) [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]byte{}, b.published[topic]...)
+}
+
+type HarnessConfig struct {
+	Certstream      certstreamorc.CertstreamConfig
+	CertstreamTopic string
+	ZGrabTopic      string
+	ZGrabPolicy     string
+	ZDNSRetry       zdnsorc.ZDNSRetryPolicy
+	IPv4            bool
+	IPv6            bool
+	ZDNSStages      []zdnsorc.SentinelZDNSStage
+	ZGrabStages     []zgraborc.SentinelZGrabStage
+}
+
+// ZDNSAnswer is the canned response of the fake zdns worker for a name
+type ZDNSAnswer struct {
+	Status string
+	Data   schema.ZDNSResultData
+	Trace  []schema.ZDNSTraceStep
+}
+
+type pendingScan struct {
+	worker    string
+	topic     string
+	scanAfter int64
+	respond   func() []byte
+}
+
+// Harness runs the whole pipeline in process. Fake zdns and zgrab workers
+// answer the worker topics with canned responses once the fake clock reaches
+// the scan_after of a task, and publish on <topic>_results like the real
+// workers do.
+type Harness struct {
+	Clock      *utils.FakeClock
+	Broker     *RecordingBroker
+	DB         *sentineldb.SentinelDB
+	Monitor    *mon.SentinelMonitor
+	Certstream *certstreamorc.SentinelCertstreamOrchestrator
+	ZDNS       []*zdnsorc.SentinelZDNSOrchestrator
+	ZGrab      []*zgraborc.SentinelZGrabOrchestrator
+
+	// ZDNSAnswers and ZGrabAnswers are keyed by name and IP. A *.<zone> key
+	// answers every name directly under the zone like DNS wildcarding does.
+	// Unknown names resolve to NXDOMAIN and unknown IPs refuse the connection.
+	ZDNSAnswers  map[string]ZDNSAnswer
+	ZGrabAnswers map[string]schema.ZGrabResultData
+
+	memory  *sentinelbroker.MemoryBroker
+	mu      sync.Mutex
+	pending []pendingScan
+}
+
+func NewHarness(name string, cfg HarnessConfig, start time.Time) (*Harness, error) {
+	memory := sentinelbroker.NewMemoryBroker()
+	memory.RequeueDelay = 0
+	h := &Harness{
+		Clock:        utils.NewFakeClock(start),
+		Broker:       NewRecordingBroker(memory),
+		DB:           sentineldb.NewTestSentinelDB(name + "-data"),
+		Monitor:      mon.NewTestSentinelMonitor(name + "-stats"),
+		ZDNSAnswers:  make(map[string]ZDNSAnswer),
+		ZGrabAnswers: make(map[string]schema.ZGrabResultData),
+		memory:       memory,
+	}
+
+	h.Certstream = certstreamorc.NewSentinelCertstreamOrchestrator(h.DB, h.Monitor, h.Broker, cfg.CertstreamTopic, cfg.Certstream)
+	h.Certstream.SetClock(h.Clock)
+
+	var err error
+	h.ZDNS, err = zdnsorc.NewSentinelZDNSStageOrchestrators(h.DB, h.Monitor, h.Broker, cfg.IPv4, cfg.IPv6, cfg.ZGrabTopic, cfg.ZGrabPolicy, cfg.ZDNSRetry, cfg.ZDNSStages)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range h.ZDNS {
+		o.SetClock(h.Clock)
+		if err := o.Subscribe(); err != nil {
+			return nil, err
+		}
+	}
+	h.ZGrab, err = zgraborc.NewSentinelZGrabStageOrchestrators(h.DB, h.Monitor, h.Broker, cfg.ZGrabStages)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range h.ZGrab {
+		o.SetClock(h.Clock)
+		if err := o.Subscribe(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the workers listen on the first topic and on every out_topic of a stage
+	zdnsTopics := []string{cfg.CertstreamTopic}
+	for _, stage := range cfg.ZDNSStages {
+		if stage.OutTopic != "" {
+			zdnsTopics = append(zdnsTopics, stage.OutTopic)
+		}
+	}
+	for _, topic := range zdnsTopics {
+		if err := memory.Subscribe(topic, "zdns", h.zdnsWorker); err != nil {
+			return nil, err
+		}
+	}
+	zgrabTopics := []string{cfg.ZGrabTopic}
+	for _, stage := range cfg.ZGrabStages {
+		if stage.OutTopic != "" {
+			zgrabTopics = append(zgrabTopics, stage.OutTopic)
+		}
+	}
+	for _, topic := range zgrabTopics {
+		if err := memory.Subscribe(topic, "zgrab", h.zgrabWorker); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *Harness) zdnsWorker(m *sentinelbroker.Message) error {
+	var input schema.ZDNSInput
+	if err := schema.Unmarshal(m.Body, &input); err != nil {
+		return err
+	}
+	h.hold("zdns", m.Topic, input.Metadata.ScanAfterUnix(), func() []byte {
+		answer, ok := h.ZDNSAnswers[input.Domain]
+		if !ok && strings.Contains(input.Domain, ".") {
+			answer, ok = h.ZDNSAnswers["*"+input.Domain[strings.Index(input.Domain, "."):]]
+		}
+		if !ok {
+			answer = ZDNSAnswer{Status: "NXDOMAIN"}
+		}
+		if answer.Status == "" {
+			answer.Status = "NOERROR"
+		}
+		answer.Data.Name = input.Domain
+		result, _ := schema.Marshal(&schema.ZDNSResult{
+			Data:      answer.Data,
+			MetaData:  input.Metadata,
+			Status:    answer.Status,
+			Timestamp: h.Clock.Now().UTC().Format(time.RFC3339),
+			Trace:     answer.Trace,
+		})
+		return result
+	})
+	return nil
+}
+
+func (h *Harness) zgrabWorker(m *sentinelbroker.Message) error {
+	var input schema.ZGrabInput
+	if err := schema.Unmarshal(m.Body, &input); err != nil {
+		return err
+	}
+	h.hold("zgrab", m.Topic, input.Metadata.ScanAfterUnix(), func() []byte {
+		data, ok := h.ZGrabAnswers[input.IP]
+		if !ok {
+			data.TLS.Status = "connection-refused"
+		}
+		data.TLS.Timestamp = h.Clock.Now().UTC().Format(time.RFC3339)
+		result, _ := schema.Marshal(&schema.ZGrabResult{
+			IP:       input.IP,
+			Domain:   input.SNI,
+			Data:     data,
+			MetaData: input.Metadata,
+		})
+		return result
+	})
+	return nil
+}
+
+func (h *Harness) hold(worker string, topic string, scanAfter int64, respond func() []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending = append(h.pending, pendingScan{worker: worker, topic: topic, scanAfter: scanAfter, respond: respond})
+}
+
+// release answers every held task of the worker that is due and reports how
+// many were
+func (h *Harness) release(worker string) int {
+	now := h.Clock.Now().Unix()
+	h.mu.Lock()
+	due := []pendingScan{}
+	held := []pendingScan{}
+	for _, scan := range h.pending {
+		if scan.worker == worker && scan.scanAfter <= now {
+			due = append(due, scan)
+		} else {
+			held = append(held, scan)
+		}
+	}
+	h.pending = held
+	h.mu.Unlock()
+
+	for _, scan := range due {
+		h.Broker.Publish(scan.topic+"_results", scan.respond())
+	}
+	return len(due)
+}
+
+// Settle runs the pipeline until every due task has been answered. The zdns
+// results due at a time are handled before the zgrab ones, so a rescan chain
+// ending then still covers the addresses resolved at the same time no matter
+// how the handlers are scheduled.
+func (h *Harness) Settle() {
+	for {
+		h.memory.WaitIdle()
+		if h.release("zdns") > 0 {
+			continue
+		}
+		if h.release("zgrab") == 0 {
+			return
+		}
+	}
+}
+
+// Advance moves the clock forward and lets the pipeline catch up
+func (h *Harness) Advance(d time.Duration) {
+	h.Clock.Advance(d)
+	h.Settle()
+}
+
+// Pending returns the number of tasks the fake workers are holding
+func (h *Harness) Pending() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.pending)
+}
+
+// FeedCertstream hands recorded certstream messages to the orchestrator
+func (h *Harness) FeedCertstream(events [][]byte) error {
+	for _, event := range events {
+		if err := h.Certstream.ProcessEvent(event); err != nil {
+			return err
+		}
+	}
+	h.Settle()
+	return nil
+}
+
+// ReadEvents loads recorded certstream messages, one JSON object per line
+func ReadEvents(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events := [][]byte{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		events = append(events, append([]byte{}, line...))
+	}
+	return events, scanner.Err()
+}
+
+// Stop releases the broker and the stores
+func (h *Harness) Stop() {
+	h.memory.Stop()
+	h.DB.Close()
+}
@@ -0,0 +1,354 @@
+package sentinelharness
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	certstreamorc "github.com/gakiwate/sentinel-orchestra/certstream-orchestra"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	testutils "github.com/gakiwate/sentinel-orchestra/sentinel-testutils"
+	zdnsorc "github.com/gakiwate/sentinel-orchestra/zdns-orchestra"
+	zgraborc "github.com/gakiwate/sentinel-orchestra/zgrab-orchestra"
+)
+
+var testStart = time.Unix(1677664800, 0)
+
+func testConfig() HarnessConfig {
+	return HarnessConfig{
+		CertstreamTopic: "zdns",
+		ZGrabTopic:      "zgrab",
+		IPv4:            true,
+		ZDNSStages: []zdnsorc.SentinelZDNSStage{
+			{Name: "4hr", InTopic: "zdns_results", OutTopic: "zdns_4hr", Delay: 4 * time.Hour},
+			{Name: "8hr", InTopic: "zdns_4hr_results", OutTopic: "zdns_8hr", Delay: 8 * time.Hour},
+			{Name: "final", InTopic: "zdns_8hr_results"},
+		},
+		ZGrabStages: []zgraborc.SentinelZGrabStage{
+			{Name: "4hr", InTopic: "zgrab_results", OutTopic: "zgrab_4hr", Delay: 4 * time.Hour},
+			{Name: "final", InTopic: "zgrab_4hr_results"},
+		},
+	}
+}
+
+func InitTest(t *testing.T) *Harness {
+	h, err := NewHarness(t.Name(), testConfig(), testStart)
+	if err != nil {
+		t.Fatalf("Unable to create harness: %s", err)
+	}
+	t.Cleanup(h.Stop)
+
+	h.ZDNSAnswers["a.valid.domain"] = ZDNSAnswer{Data: schema.ZDNSResultData{IPv4Addresses: []string{"192.0.2.1"}}}
+	var served schema.ZGrabResultData
+	served.TLS.Status = "success"
+	// the final certificate for the precert serial 0A1B2C in the recorded feed
+	served.TLS.Result.HandshakeLog.ServerCertificates.Certificate.Raw = testutils.Certificate(t, testutils.TestCert{
+		Serial:    0x0A1B2C,
+		Domains:   []string{"a.valid.domain"},
+		Issuer:    testutils.R3,
+		NotBefore: testStart,
+	})
+	h.ZGrabAnswers["192.0.2.1"] = served
+
+	events, err := ReadEvents("testdata/certstream.jsonl")
+	if err != nil {
+		t.Fatalf("Unable to read recorded events: %s", err)
+	}
+	if err := h.FeedCertstream(events); err != nil {
+		t.Fatalf("Unable to feed recorded events: %s", err)
+	}
+	return h
+}
+
+func lines(data []byte) int {
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestCertstreamToZDNS(t *testing.T) {
+	h := InitTest(t)
+
+	published := h.Broker.Published("zdns")
+	if len(published) != 2 {
+		t.Fatalf("Expected 2 zdns inputs but got %d", len(published))
+	}
+	domains := map[string]bool{}
+	for _, body := range published {
+		var input schema.ZDNSInput
+		if err := schema.Unmarshal(body, &input); err != nil {
+			t.Fatalf("Unable to parse zdns input %s: %s", body, err)
+		}
+		domains[input.Domain] = true
+		if input.Metadata.ScanAfterUnix() != testStart.Unix() {
+			t.Errorf("Expected scan_after %d but got %s", testStart.Unix(), input.Metadata.ScanAfter)
+		}
+	}
+	if !domains["a.valid.domain"] || !domains["b.valid.domain"] {
+		t.Errorf("Expected a.valid.domain and b.valid.domain but got %v", domains)
+	}
+	if len(h.Broker.Published("certstream")) != 2 {
+		t.Errorf("Expected both certificates on the certstream topic but got %d", len(h.Broker.Published("certstream")))
+	}
+
+	cnt := h.Monitor.Count(mon.CertstreamCerts)
+	if cnt != 3 {
+		t.Errorf("Expected cert_cnt 3 but got %d", cnt)
+	}
+	cnt = h.Monitor.Count(mon.CertstreamDomains)
+	if cnt != 2 {
+		t.Errorf("Expected domain_cnt 2 but got %d", cnt)
+	}
+	data, _ := h.DB.Get("certstream|sha1|a.valid.domain")
+	if lines(data) != 1 {
+		t.Errorf("Expected one certificate for a.valid.domain but got %s", data)
+	}
+}
+
+func TestDelayStages(t *testing.T) {
+	h := InitTest(t)
+
+	// the first zdns and zgrab scans happen right away
+	cnt := h.Monitor.Count(mon.ZDNSResults)
+	if cnt != 2 {
+		t.Errorf("Expected 2 zdns results but got %d", cnt)
+	}
+	cnt = h.Monitor.Count(mon.ZDNSErrors)
+	if cnt != 1 {
+		t.Errorf("Expected 1 zdns error but got %d", cnt)
+	}
+	data, _ := h.DB.Get("zgrab|a.valid.domain|192.0.2.1")
+	if lines(data) != 1 {
+		t.Errorf("Expected one grab but got %s", data)
+	}
+
+	// nothing is due before the first delay has passed
+	h.Advance(4*time.Hour - time.Second)
+	if len(h.Broker.Published("zdns_4hr_results")) != 0 {
+		t.Errorf("Expected no 4hr results before the delay passed")
+	}
+
+	h.Advance(time.Second)
+	if len(h.Broker.Published("zdns_4hr_results")) != 2 {
+		t.Errorf("Expected 2 4hr results but got %d", len(h.Broker.Published("zdns_4hr_results")))
+	}
+	for _, body := range h.Broker.Published("zdns_8hr") {
+		var input schema.ZDNSInput
+		schema.Unmarshal(body, &input)
+		expected := testStart.Add(12 * time.Hour).Unix()
+		if input.Metadata.ScanAfterUnix() != expected {
+			t.Errorf("Expected 8hr scan_after %d but got %s", expected, input.Metadata.ScanAfter)
+		}
+	}
+
+	h.Advance(8 * time.Hour)
+	cnt = h.Monitor.Count(mon.ZDNSResults)
+	if cnt != 6 {
+		t.Errorf("Expected 6 zdns results but got %d", cnt)
+	}
+	data, _ = h.DB.Get("zdns|ips|a.valid.domain")
+	if lines(data) != 3 {
+		t.Errorf("Expected 3 zdns observations but got %s", data)
+	}
+	// the final stage does not reschedule
+	if len(h.Broker.Published("zdns_8hr_results")) != 2 || h.Pending() != 1 {
+		t.Errorf("Expected the chain to end with one zgrab rescan pending but %d tasks are held", h.Pending())
+	}
+
+	// grabs at 0h, 4h (zdns 4hr and zgrab 4hr), 8h (zgrab 4hr) and 12h (zdns final)
+	data, _ = h.DB.Get("zgrab|a.valid.domain|192.0.2.1")
+	if lines(data) != 5 {
+		t.Errorf("Expected 5 grabs but got %s", data)
+	}
+	first := h.Monitor.Count(mon.ZGrabAnalysis, "4hr", "match")
+	final := h.Monitor.Count(mon.ZGrabAnalysis, "final", "match")
+	if first != 3 || final != 2 {
+		t.Errorf("Expected 3 and 2 matches but got %d and %d", first, final)
+	}
+}
+
+func TestWildcardProbes(t *testing.T) {
+	cfg := testConfig()
+	cfg.Certstream.Wildcard = certstreamorc.CertstreamWildcardConfig{Labels: []string{"www"}, ProbeRandom: true}
+	h, err := NewHarness(t.Name(), cfg, testStart)
+	if err != nil {
+		t.Fatalf("Unable to create harness: %s", err)
+	}
+	t.Cleanup(h.Stop)
+	h.ZDNSAnswers["*.b.valid.domain"] = ZDNSAnswer{Data: schema.ZDNSResultData{IPv4Addresses: []string{"192.0.2.2"}}}
+
+	events, err := ReadEvents("testdata/certstream.jsonl")
+	if err != nil {
+		t.Fatalf("Unable to read recorded events: %s", err)
+	}
+	if err := h.FeedCertstream(events); err != nil {
+		t.Fatalf("Unable to feed recorded events: %s", err)
+	}
+
+	inputs := map[string]schema.Metadata{}
+	for _, body := range h.Broker.Published("zdns") {
+		var input schema.ZDNSInput
+		schema.Unmarshal(body, &input)
+		inputs[input.Domain] = input.Metadata
+	}
+	if len(inputs) != 4 {
+		t.Fatalf("Expected the names, a label and a random probe but got %v", inputs)
+	}
+	if inputs["a.valid.domain"].Wildcard || !inputs["b.valid.domain"].Wildcard {
+		t.Errorf("Expected only b.valid.domain to be marked wildcard")
+	}
+	if probe := inputs["www.b.valid.domain"]; !probe.Wildcard || probe.Probe != schema.ProbeLabel {
+		t.Errorf("Expected www.b.valid.domain to be a label probe but got %+v", probe)
+	}
+
+	var wildcard zdnsorc.SentinelDBWildcard
+	value, _ := h.DB.Get("zdns|wildcard|b.valid.domain")
+	if err := json.Unmarshal(value, &wildcard); err != nil {
+		t.Fatalf("Unable to read wildcard record %s: %s", value, err)
+	}
+	if !wildcard.Wildcard || !strings.HasPrefix(wildcard.Probe, "sentinel-") {
+		t.Errorf("Expected b.valid.domain to be wildcarded but got %+v", wildcard)
+	}
+	// the random probe is neither rescheduled nor grabbed, only the www probe
+	// resolves
+	if len(h.Broker.Published("zdns_4hr")) != 3 || len(h.Broker.Published("zgrab")) != 1 {
+		t.Errorf("Expected 3 rescans and 1 grab but got %d and %d",
+			len(h.Broker.Published("zdns_4hr")), len(h.Broker.Published("zgrab")))
+	}
+}
+
+func TestZGrabPolicyNew(t *testing.T) {
+	cfg := testConfig()
+	cfg.ZGrabPolicy = zdnsorc.ZGrabPolicyNew
+	h, err := NewHarness(t.Name(), cfg, testStart)
+	if err != nil {
+		t.Fatalf("Unable to create harness: %s", err)
+	}
+	t.Cleanup(h.Stop)
+	h.ZDNSAnswers["a.valid.domain"] = ZDNSAnswer{Data: schema.ZDNSResultData{IPv4Addresses: []string{"192.0.2.1"}}}
+
+	events, err := ReadEvents("testdata/certstream.jsonl")
+	if err != nil {
+		t.Fatalf("Unable to read recorded events: %s", err)
+	}
+	if err := h.FeedCertstream(events); err != nil {
+		t.Fatalf("Unable to feed recorded events: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		h.Advance(4 * time.Hour)
+	}
+
+	// the 4hr zdns result is covered by the zgrab chain started at 0h, the
+	// final zdns result at 12h comes after that chain ended at 4h
+	data, _ := h.DB.Get("zgrab|a.valid.domain|192.0.2.1")
+	if lines(data) != 3 {
+		t.Errorf("Expected grabs at 0h, 4h and 12h but got %s", data)
+	}
+	skipped := h.Monitor.Count(mon.ZDNSZGrabSkipped)
+	if skipped != 1 {
+		t.Errorf("Expected 1 skipped grab but got %d", skipped)
+	}
+}
+
+func TestZDNSRecords(t *testing.T) {
+	h, err := NewHarness(t.Name(), testConfig(), testStart)
+	if err != nil {
+		t.Fatalf("Unable to create harness: %s", err)
+	}
+	t.Cleanup(h.Stop)
+	// alookup returns the addresses, the records it followed are in the trace
+	h.ZDNSAnswers["a.valid.domain"] = ZDNSAnswer{
+		Data: schema.ZDNSResultData{IPv4Addresses: []string{"192.0.2.1"}},
+		Trace: []schema.ZDNSTraceStep{{
+			Name: "a.valid.domain",
+			Results: schema.ZDNSResultData{
+				Resolver: "192.0.2.53:53",
+				Answers: []schema.ZDNSRecord{
+					{Type: "CNAME", Name: "a.valid.domain", TTL: 300, Answer: "a.cdn.domain."},
+					{Type: "A", Name: "a.cdn.domain", TTL: 20, Answer: "192.0.2.1"},
+				},
+			},
+		}},
+	}
+
+	events, err := ReadEvents("testdata/certstream.jsonl")
+	if err != nil {
+		t.Fatalf("Unable to read recorded events: %s", err)
+	}
+	if err := h.FeedCertstream(events); err != nil {
+		t.Fatalf("Unable to feed recorded events: %s", err)
+	}
+
+	var stored zdnsorc.SentinelDBResult
+	value, _ := h.DB.Get("zdns|ips|a.valid.domain")
+	if err := json.Unmarshal(value, &stored); err != nil {
+		t.Fatalf("Unable to read %s: %s", value, err)
+	}
+	if stored.Status != "NOERROR" || len(stored.CNAMEs) != 1 || stored.CNAMEs[0] != "a.cdn.domain" ||
+		len(stored.Records) != 2 || stored.Records[0].TTL != 300 || stored.Resolver != "192.0.2.53:53" {
+		t.Errorf("Unexpected stored result %+v", stored)
+	}
+	value, _ = h.DB.Get("zdns|ips|b.valid.domain")
+	if err := json.Unmarshal(value, &stored); err != nil || stored.Status != "NXDOMAIN" {
+		t.Errorf("Expected NXDOMAIN to be stored but got %s", value)
+	}
+}
+
+func TestZDNSRetry(t *testing.T) {
+	cfg := testConfig()
+	cfg.ZDNSRetry = zdnsorc.ZDNSRetryPolicy{
+		Statuses:       map[string]string{"TIMEOUT": zdnsorc.StatusRetry, "NXDOMAIN": zdnsorc.StatusStop},
+		MaxAttempts:    2,
+		InitialBackoff: time.Minute,
+	}
+	h, err := NewHarness(t.Name(), cfg, testStart)
+	if err != nil {
+		t.Fatalf("Unable to create harness: %s", err)
+	}
+	t.Cleanup(h.Stop)
+	h.ZDNSAnswers["a.valid.domain"] = ZDNSAnswer{Status: "TIMEOUT"}
+
+	events, err := ReadEvents("testdata/certstream.jsonl")
+	if err != nil {
+		t.Fatalf("Unable to read recorded events: %s", err)
+	}
+	if err := h.FeedCertstream(events); err != nil {
+		t.Fatalf("Unable to feed recorded events: %s", err)
+	}
+
+	// the timeout is retried on the zdns topic, NXDOMAIN ends the chain
+	if len(h.Broker.Published("zdns")) != 3 || len(h.Broker.Published("zdns_4hr")) != 0 {
+		t.Fatalf("Expected 1 retry and no rescans but got %d zdns inputs and %d rescans",
+			len(h.Broker.Published("zdns")), len(h.Broker.Published("zdns_4hr")))
+	}
+	stopped := h.Monitor.Count(mon.ZDNSStopped, "4hr")
+	if stopped != 1 {
+		t.Errorf("Expected b.valid.domain to be stopped but got %d", stopped)
+	}
+
+	h.ZDNSAnswers["a.valid.domain"] = ZDNSAnswer{Data: schema.ZDNSResultData{IPv4Addresses: []string{"192.0.2.1"}}}
+	h.Advance(time.Minute)
+
+	published := h.Broker.Published("zdns_4hr")
+	if len(published) != 1 || len(h.Broker.Published("zgrab")) != 1 {
+		t.Fatalf("Expected 1 rescan and 1 grab after the retry but got %d and %d",
+			len(published), len(h.Broker.Published("zgrab")))
+	}
+	var input schema.ZDNSInput
+	if err := schema.Unmarshal(published[0], &input); err != nil {
+		t.Fatalf("Unable to parse zdns input %s: %s", published[0], err)
+	}
+	if input.Metadata.Attempt != 0 || input.Metadata.ScanAfterUnix() != testStart.Add(time.Minute+4*time.Hour).Unix() {
+		t.Errorf("Unexpected rescan metadata %+v", input.Metadata)
+	}
+
+	for _, status := range []string{"TIMEOUT", "NOERROR", "NXDOMAIN"} {
+		if cnt := h.Monitor.Count(mon.ZDNSStatus, "4hr", status); cnt != 1 {
+			t.Errorf("Expected 1 %s result but got %d", status, cnt)
+		}
+	}
+	if cnt := h.Monitor.Count(mon.ZDNSRetries, "4hr"); cnt != 1 {
+		t.Errorf("Expected 1 retry but got %d", cnt)
+	}
+}
@@ -0,0 +1,164 @@
+package sentinelmon
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Counter defines a counter of the stats store. The counters are registered
+// below and incremented through the monitor with one value per label.
+type Counter struct {
+	// Name is <component>.<metric>, exported as sentinel_<component>_<metric>_total
+	Name   string
+	Help   string
+	Labels []string
+}
+
+var counters = make(map[string]*Counter)
+
+// Register adds a counter definition. Names have to be unique.
+func Register(c Counter) *Counter {
+	if _, ok := counters[c.Name]; ok {
+		panic(fmt.Sprintf("counter %s registered twice", c.Name))
+	}
+	if strings.ContainsAny(c.Name, "|=") {
+		panic(fmt.Sprintf("invalid counter name %s", c.Name))
+	}
+	counters[c.Name] = &c
+	return &c
+}
+
+// Counters returns the registered counters sorted by name
+func Counters() []*Counter {
+	all := make([]*Counter, 0, len(counters))
+	for _, c := range counters {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// Key returns the store key of the counter for the label values, which is
+// <name>|<label>=<value>|... in the order the labels were registered
+func (c *Counter) Key(values ...string) (string, error) {
+	if len(values) != len(c.Labels) {
+		return "", fmt.Errorf("counter %s takes labels %v but got %v", c.Name, c.Labels, values)
+	}
+	var key strings.Builder
+	key.WriteString(c.Name)
+	for idx, label := range c.Labels {
+		key.WriteString("|" + label + "=" + strings.ReplaceAll(values[idx], "|", "_"))
+	}
+	return key.String(), nil
+}
+
+// parseKey returns the counter and label values of a store key
+func parseKey(key string) (*Counter, []string, bool) {
+	fields := strings.Split(key, "|")
+	c, ok := counters[fields[0]]
+	if !ok || len(fields)-1 != len(c.Labels) {
+		return nil, nil, false
+	}
+	values := make([]string, len(c.Labels))
+	for idx, field := range fields[1:] {
+		label, value, found := strings.Cut(field, "=")
+		if !found || label != c.Labels[idx] {
+			return nil, nil, false
+		}
+		values[idx] = value
+	}
+	return c, values, true
+}
+
+// Incr adds one to the counter
+func (mon *SentinelMonitor) Incr(c *Counter, values ...string) {
+	mon.IncrBy(c, 1, values...)
+}
+
+// IncrBy adds n to the counter
+func (mon *SentinelMonitor) IncrBy(c *Counter, n int64, values ...string) {
+	key, err := c.Key(values...)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	mon.Stats.IncrBy(key, n)
+}
+
+// Count returns the total of the counter
+func (mon *SentinelMonitor) Count(c *Counter, values ...string) int {
+	key, err := c.Key(values...)
+	if err != nil {
+		log.Error(err)
+		return 0
+	}
+	count, _ := mon.Stats.Get(key)
+	return count
+}
+
+// Certstream and CT log counters
+var (
+	CertstreamConnects          = Register(Counter{Name: "certstream.connects", Help: "Connections to certstream"})
+	CertstreamConnectErrors     = Register(Counter{Name: "certstream.connect_errors", Help: "Failed connections to certstream"})
+	CertstreamDisconnects       = Register(Counter{Name: "certstream.disconnects", Help: "Connections to certstream that were lost"})
+	CertstreamGaps              = Register(Counter{Name: "certstream.gaps", Help: "Reconnections that may have missed certificates"})
+	CertstreamGapSeconds        = Register(Counter{Name: "certstream.gap_seconds", Help: "Time spent disconnected from certstream"})
+	CertstreamCerts             = Register(Counter{Name: "certstream.certs", Help: "Certificates received"})
+	CertstreamCertErrors        = Register(Counter{Name: "certstream.cert_errors", Help: "Certificates that could not be parsed"})
+	CertstreamCertRecords       = Register(Counter{Name: "certstream.cert_records", Help: "Certificates stored"})
+	CertstreamDomains           = Register(Counter{Name: "certstream.domains", Help: "Certificate names scheduled for zdns, without wildcard probes"})
+	CertstreamFiltered          = Register(Counter{Name: "certstream.filtered", Help: "Domains dropped by the filter"})
+	CertstreamFilterMatches     = Register(Counter{Name: "certstream.filter_matches", Help: "Domains by the filter rule deciding on them", Labels: []string{"rule"}})
+	CertstreamDedupSuppressed   = Register(Counter{Name: "certstream.dedup_suppressed", Help: "Domains not scheduled as they were scheduled recently"})
+	CertstreamDedupExpired      = Register(Counter{Name: "certstream.dedup_expired", Help: "Dedup entries swept after the window"})
+	CertstreamWildcardProbes    = Register(Counter{Name: "certstream.wildcard_probes", Help: "Names probed under wildcard certificates", Labels: []string{"probe"}})
+	CertstreamX509              = Register(Counter{Name: "certstream.x509", Help: "Final certificates received"})
+	CertstreamX509Linked        = Register(Counter{Name: "certstream.x509_linked", Help: "Final certificates linked to their precertificate"})
+	CertstreamX509Unlinked      = Register(Counter{Name: "certstream.x509_unlinked", Help: "Final certificates without a known precertificate"})
+	CertstreamX509UnseenDomains = Register(Counter{Name: "certstream.x509_unseen_domains", Help: "Domains of final certificates missing from the precertificate"})
+	CertstreamPrecertsExpired   = Register(Counter{Name: "certstream.precerts_expired", Help: "Precertificates swept after the link window"})
+
+	CTLogEntries     = Register(Counter{Name: "ctlog.entries", Help: "Entries read from a CT log", Labels: []string{"log"}})
+	CTLogParseErrors = Register(Counter{Name: "ctlog.parse_errors", Help: "CT log entries that could not be parsed", Labels: []string{"log"}})
+	CTLogErrors      = Register(Counter{Name: "ctlog.errors", Help: "Failed requests to a CT log", Labels: []string{"log"}})
+)
+
+// ZDNS and ZGrab counters
+var (
+	ZDNSResults          = Register(Counter{Name: "zdns.results", Help: "ZDNS results received"})
+	ZDNSErrors           = Register(Counter{Name: "zdns.errors", Help: "ZDNS results with a status other than NOERROR"})
+	ZDNSStatus           = Register(Counter{Name: "zdns.status", Help: "ZDNS results by status", Labels: []string{"stage", "status"}})
+	ZDNSAddresses        = Register(Counter{Name: "zdns.addresses", Help: "Addresses resolved", Labels: []string{"stage", "ip_version"}})
+	ZDNSChanges          = Register(Counter{Name: "zdns.changes", Help: "Results compared with the previous one of the name", Labels: []string{"stage", "outcome"}})
+	ZDNSRetries          = Register(Counter{Name: "zdns.retries", Help: "Lookups retried", Labels: []string{"stage"}})
+	ZDNSRetriesExhausted = Register(Counter{Name: "zdns.retries_exhausted", Help: "Lookups that failed after every retry", Labels: []string{"stage"}})
+	ZDNSStopped          = Register(Counter{Name: "zdns.stopped", Help: "Names whose rescan chain was stopped by their status", Labels: []string{"stage"}})
+	ZDNSCNAMEs           = Register(Counter{Name: "zdns.cnames", Help: "Results with a CNAME chain"})
+	ZDNSWildcardZones    = Register(Counter{Name: "zdns.wildcard_zones", Help: "Zones probed for DNS wildcarding", Labels: []string{"wildcard"}})
+	ZDNSZGrabPublished   = Register(Counter{Name: "zdns.zgrab_published", Help: "Addresses sent to zgrab"})
+	ZDNSZGrabSkipped     = Register(Counter{Name: "zdns.zgrab_skipped", Help: "Addresses not sent to zgrab as they are already rescanned"})
+
+	ZGrabResults       = Register(Counter{Name: "zgrab.results", Help: "ZGrab results received"})
+	ZGrabAnalysis      = Register(Counter{Name: "zgrab.analysis", Help: "Served certificates compared with the CT logged one", Labels: []string{"stage", "outcome"}})
+	ZGrabChainsExpired = Register(Counter{Name: "zgrab.chains_expired", Help: "Rescan chain entries swept after their grace"})
+)
+
+// Scheduler, quarantine and registrable domain counters
+var (
+	SchedulerImmediate     = Register(Counter{Name: "scheduler.immediate", Help: "Messages published without being scheduled"})
+	SchedulerScheduled     = Register(Counter{Name: "scheduler.scheduled", Help: "Messages held until their scan_after"})
+	SchedulerPublished     = Register(Counter{Name: "scheduler.published", Help: "Held messages published once due"})
+	SchedulerPublishErrors = Register(Counter{Name: "scheduler.publish_errors", Help: "Held messages that could not be published"})
+	SchedulerInvalid       = Register(Counter{Name: "scheduler.invalid", Help: "Held messages that could not be read"})
+	SchedulerLagSeconds    = Register(Counter{Name: "scheduler.lag_seconds", Help: "Time held messages were published after they were due"})
+
+	QuarantineMessages = Register(Counter{Name: "quarantine.messages", Help: "Messages quarantined", Labels: []string{"topic"}})
+	QuarantineReplayed = Register(Counter{Name: "quarantine.replayed", Help: "Quarantined messages replayed"})
+
+	// the records of each registrable domain are served on /registrable
+	RegistrableRecords = Register(Counter{Name: "registrable.records", Help: "Records indexed by registrable domain", Labels: []string{"source"}})
+	RegistrableUnknown = Register(Counter{Name: "registrable.unknown", Help: "Records without a registrable domain", Labels: []string{"source"}})
+)
@@ -0,0 +1,87 @@
+package sentinelmon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCounterKey(t *testing.T) {
+	key, err := ZDNSStatus.Key("4hr", "SERVFAIL")
+	if err != nil || key != "zdns.status|stage=4hr|status=SERVFAIL" {
+		t.Errorf("Unexpected key %s (%v)", key, err)
+	}
+	if _, err := ZDNSStatus.Key("4hr"); err == nil {
+		t.Errorf("Expected a missing label value to be rejected")
+	}
+	counter, values, ok := parseKey(key)
+	if !ok || counter != ZDNSStatus || strings.Join(values, ",") != "4hr,SERVFAIL" {
+		t.Errorf("Unexpected counter %v %v for %s", counter, values, key)
+	}
+	for _, key := range []string{"zdns.status|stage=4hr", "zdns.status|status=4hr|stage=SERVFAIL", "zdns.unknown", "monitor|zdns|result_cnt"} {
+		if _, _, ok := parseKey(key); ok {
+			t.Errorf("Expected %s not to parse", key)
+		}
+	}
+
+	mon := NewTestSentinelMonitor("sentinel-monitor-counter-test-stats")
+	mon.Incr(CTLogEntries, "argon|2023")
+	if mon.Count(CTLogEntries, "argon|2023") != 1 || mon.Count(CTLogEntries, "argon_2023") != 1 {
+		t.Errorf("Expected | in label values to be replaced")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	mon := NewTestSentinelMonitor("sentinel-monitor-migrate-test-stats")
+	old := map[string]int64{
+		"monitor|certstream|cert_cnt":     4,
+		"monitor|certstream|cert_err_cnt": 1,
+		"monitor|certstream|domain_cnt":   5,
+		"monitor|zdns|result_cnt":         3,
+		"monitor|zdns|error_cnt":          2,
+		"stats.zgrab.result_cnt":          10,
+	}
+	for key, n := range old {
+		mon.Stats.IncrBy(key, n)
+	}
+	// counted under the new name before the migration
+	mon.IncrBy(ZGrabResults, 1)
+
+	migrated, err := mon.Migrate()
+	if err != nil || migrated != len(old) {
+		t.Fatalf("Expected %d counters to be migrated but got %d (%v)", len(old), migrated, err)
+	}
+	for _, expected := range []struct {
+		counter *Counter
+		values  []string
+		count   int
+	}{
+		{CertstreamCerts, nil, 4},
+		{CertstreamCertErrors, nil, 1},
+		{CertstreamDomains, nil, 5},
+		{ZDNSResults, nil, 3},
+		{ZDNSErrors, nil, 2},
+		{ZGrabResults, nil, 11},
+	} {
+		if count := mon.Count(expected.counter, expected.values...); count != expected.count {
+			t.Errorf("Expected %s %v to be %d but got %d", expected.counter.Name, expected.values, expected.count, count)
+		}
+	}
+	for key := range mon.Stats.FetchData(nil) {
+		if _, _, ok := parseKey(key); !ok {
+			t.Errorf("Expected only registered counters but found %s", key)
+		}
+	}
+	buckets, _ := mon.Stats.FetchBuckets([]byte("monitor|"), "day", 0, 1<<40)
+	if len(buckets) != 0 {
+		t.Errorf("Expected the buckets to be migrated but got %v", buckets)
+	}
+	buckets, _ = mon.Stats.FetchBuckets([]byte("zgrab.results"), "day", 0, 1<<40)
+	if len(buckets["zgrab.results"]) != 1 || buckets["zgrab.results"][0].Count != 11 {
+		t.Errorf("Unexpected migrated buckets %v", buckets)
+	}
+
+	// running it again finds nothing to do
+	if migrated, _ := mon.Migrate(); migrated != 0 {
+		t.Errorf("Expected nothing left to migrate but moved %d", migrated)
+	}
+}
@@ -0,0 +1,99 @@
+package sentinelmon
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// counterCollector exports the registered counters of the stats store on
+// every scrape
+type counterCollector struct {
+	mon *SentinelMonitor
+}
+
+// metricName is the Prometheus name of the counter
+func metricName(c *Counter) string {
+	return "sentinel_" + strings.ReplaceAll(c.Name, ".", "_") + "_total"
+}
+
+func counterDesc(c *Counter) *prometheus.Desc {
+	return prometheus.NewDesc(metricName(c), c.Help, c.Labels, nil)
+}
+
+func (c counterCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, counter := range Counters() {
+		ch <- counterDesc(counter)
+	}
+}
+
+// Collect only reads the keys of the registered counters
+func (c counterCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, counter := range Counters() {
+		desc := counterDesc(counter)
+		for key, value := range c.mon.Stats.FetchData([]byte(counter.Name)) {
+			// the prefix also matches counters named counter.Name + "_..."
+			parsed, values, ok := parseKey(key)
+			if !ok || parsed != counter {
+				continue
+			}
+			metric, err := prometheus.NewConstMetric(desc, prometheus.CounterValue, float64(value), values...)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			ch <- metric
+		}
+	}
+}
+
+// queueCollector reports how many messages wait on each topic
+type queueCollector struct {
+	desc   *prometheus.Desc
+	topics []string
+	depth  func(topic string) (int64, error)
+}
+
+func (c queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c queueCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, topic := range c.topics {
+		depth, err := c.depth(topic)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(depth), topic)
+	}
+}
+
+// QueueDepth exports the depth of topics as sentinel_queue_depth
+func (mon *SentinelMonitor) QueueDepth(topics []string, depth func(topic string) (int64, error)) {
+	mon.registry.MustRegister(queueCollector{
+		desc:   prometheus.NewDesc("sentinel_queue_depth", "Messages waiting on a topic", []string{"topic"}, nil),
+		topics: topics,
+		depth:  depth,
+	})
+}
+
+// Gauge exports the value of fn as the gauge name
+func (mon *SentinelMonitor) Gauge(name string, help string, fn func() float64) {
+	mon.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, fn))
+}
+
+// ObserveLatency records how long a stage of component took to handle a message
+func (mon *SentinelMonitor) ObserveLatency(component string, stage string, d time.Duration) {
+	mon.latency.WithLabelValues(component, stage).Observe(d.Seconds())
+}
+
+func newLatency() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sentinel_processing_seconds",
+		Help:    "Time taken to handle a message",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"component", "stage"})
+}
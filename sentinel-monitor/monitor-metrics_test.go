@@ -0,0 +1,34 @@
+package sentinelmon
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	mon := NewTestSentinelMonitor("sentinel-monitor-test-stats")
+	mon.Incr(ZDNSStatus, "4hr", "NOERROR")
+	mon.Incr(ZDNSStatus, "4hr", "NOERROR")
+	mon.ObserveLatency("zdns", "4hr", 3*time.Millisecond)
+	mon.QueueDepth([]string{"zdns", "zgrab"}, func(topic string) (int64, error) {
+		return int64(len(topic)), nil
+	})
+	mon.Gauge("sentinel_scheduler_backlog", "Scans held until their scan_after", func() float64 { return 7 })
+
+	w := httptest.NewRecorder()
+	mon.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, expected := range []string{
+		"# HELP sentinel_zdns_status_total ZDNS results by status",
+		`sentinel_zdns_status_total{stage="4hr",status="NOERROR"} 2`,
+		`sentinel_processing_seconds_count{component="zdns",stage="4hr"} 1`,
+		`sentinel_queue_depth{topic="zgrab"} 5`,
+		`sentinel_scheduler_backlog 7`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %s in\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package sentinelmon
+
+// migrations maps the keys counters were stored under before they were
+// registered to their counter. None of them had labels.
+var migrations = map[string]*Counter{
+	"monitor|certstream|cert_cnt":     CertstreamCerts,
+	"monitor|certstream|cert_err_cnt": CertstreamCertErrors,
+	"monitor|certstream|domain_cnt":   CertstreamDomains,
+	"monitor|zdns|result_cnt":         ZDNSResults,
+	"monitor|zdns|error_cnt":          ZDNSErrors,
+	"stats.zgrab.result_cnt":          ZGrabResults,
+}
+
+// migratedKey returns the key of the registered counter an old key maps to
+func migratedKey(key string) (string, bool) {
+	counter, ok := migrations[key]
+	if !ok {
+		return "", false
+	}
+	return counter.Name, true
+}
+
+// migratedPrefixes cover every key a migration matches. Buckets are only
+// written together with their total, so stores without these keys are
+// not scanned.
+var migratedPrefixes = []string{"monitor|", "stats.zgrab."}
+
+// Migrate moves the totals and buckets of counters stored under their old
+// keys to the keys of the registered counters
+func (mon *SentinelMonitor) Migrate() (int, error) {
+	for _, prefix := range migratedPrefixes {
+		if mon.Stats.HasPrefix([]byte(prefix)) {
+			return mon.Stats.RenameKeys(migratedKey)
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,95 @@
+package sentinelmon
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+)
+
+// windowBuckets is how many buckets are returned when no range is given
+const windowBuckets = 60
+
+type windowCounter struct {
+	Total int `json:"total"`
+	// Rate is the average per second over the range
+	Rate    float64        `json:"rate"`
+	Buckets []utils.Bucket `json:"buckets"`
+}
+
+type windowStats struct {
+	Resolution string                   `json:"resolution"`
+	From       int64                    `json:"from"`
+	To         int64                    `json:"to"`
+	Counters   map[string]windowCounter `json:"counters"`
+}
+
+// windowStats serves the counts of the counters in the buckets of the given
+// resolution overlapping [from, to). The range defaults to the last 60
+// buckets and from is moved back to the start of its bucket.
+func (mon *SentinelMonitor) windowStats(w http.ResponseWriter, r *http.Request, prefix []byte) {
+	query := r.URL.Query()
+	resolution := query.Get("resolution")
+	if resolution == "" {
+		resolution = "minute"
+	}
+	width, ok := utils.Resolutions[resolution]
+	if !ok {
+		http.Error(w, "resolution must be minute, hour or day", http.StatusBadRequest)
+		return
+	}
+	seconds := int64(width.Seconds())
+
+	to := time.Now().Unix()
+	if v := query.Get("to"); v != "" {
+		var err error
+		if to, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "to must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	from := to - windowBuckets*seconds
+	if v := query.Get("from"); v != "" {
+		var err error
+		if from, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "from must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	from -= from % seconds
+	if from >= to {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	buckets, err := mon.Stats.FetchBuckets(prefix, resolution, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stats := windowStats{
+		Resolution: resolution,
+		From:       from,
+		To:         to,
+		Counters:   make(map[string]windowCounter),
+	}
+	for key, counts := range buckets {
+		counter := windowCounter{Buckets: counts}
+		for _, bucket := range counts {
+			counter.Total += bucket.Count
+		}
+		counter.Rate = float64(counter.Total) / float64(to-from)
+		stats.Counters[key] = counter
+	}
+
+	jsonData, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonData)
+}
@@ -0,0 +1,42 @@
+package sentinelmon
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+)
+
+func TestWindowStats(t *testing.T) {
+	mon := NewTestSentinelMonitor("sentinel-monitor-window-test-stats")
+	clock := utils.NewFakeClock(time.Unix(1677664800, 0))
+	mon.Stats.SetClock(clock)
+	mon.IncrBy(ZDNSResults, 30)
+	clock.Advance(time.Minute)
+	mon.IncrBy(ZDNSResults, 90)
+	mon.Incr(ZGrabAnalysis, "4hr", "match")
+
+	w := httptest.NewRecorder()
+	mon.StatsHandler()(w, httptest.NewRequest("GET", "/stats?prefix=zdns.&from=1677664830&to=1677664920", nil))
+	var stats windowStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Unable to parse %s: %s", w.Body.String(), err)
+	}
+	counter := stats.Counters["zdns.results"]
+	if stats.From != 1677664800 || len(stats.Counters) != 1 || counter.Total != 120 || len(counter.Buckets) != 2 || counter.Rate != 1 {
+		t.Errorf("Unexpected window %+v", stats)
+	}
+
+	w = httptest.NewRecorder()
+	mon.StatsHandler()(w, httptest.NewRequest("GET", "/stats?resolution=week", nil))
+	if w.Code != 400 {
+		t.Errorf("Expected 400 for an unknown resolution but got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mon.StatsHandler()(w, httptest.NewRequest("GET", "/stats?prefix=zgrab.", nil))
+	if w.Body.String() != `{"zgrab.analysis|stage=4hr|outcome=match":1}` {
+		t.Errorf("Unexpected totals %s", w.Body.String())
+	}
+}
@@ -1,25 +1,61 @@
 package sentinelmon
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 )
 
 type SentinelMonitor struct {
 	Stats utils.SentinelCounters
+	// Addr is where Serve listens
+	Addr     string
+	handlers map[string]http.Handler
+	registry *prometheus.Registry
+	latency  *prometheus.HistogramVec
 }
 
-func (mon *SentinelMonitor) Serve() error {
+// Handle serves additional endpoints next to /stats. It has to be called
+// before Serve.
+func (mon *SentinelMonitor) Handle(pattern string, handler http.Handler) {
+	if mon.handlers == nil {
+		mon.handlers = make(map[string]http.Handler)
+	}
+	mon.handlers[pattern] = handler
+}
+
+// MetricsHandler serves the counters and metrics in the Prometheus format
+func (mon *SentinelMonitor) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(mon.registry, promhttp.HandlerOpts{})
+}
 
-	statsHandler := func(w http.ResponseWriter, r *http.Request) {
+// StatsHandler serves the counter totals on /stats, or their counts over a
+// time range when ?from=, ?to= or ?resolution= is given
+func (mon *SentinelMonitor) StatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/stats" {
+			// Optionally limited to the counters starting with ?prefix=
+			var prefix []byte
+			query := r.URL.Query()
+			if p := query.Get("prefix"); p != "" {
+				prefix = []byte(p)
+			}
+			if query.Has("from") || query.Has("to") || query.Has("resolution") {
+				mon.windowStats(w, r, prefix)
+				return
+			}
 			// Set the response headers
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
 			// Send the JSON data as the response body
-			data := mon.Stats.FetchData(nil)
+			data := mon.Stats.FetchData(prefix)
 			jsonData, _ := json.Marshal(data)
 			w.Write(jsonData)
 		} else {
@@ -27,13 +63,62 @@ func (mon *SentinelMonitor) Serve() error {
 			http.NotFound(w, r)
 		}
 	}
+}
+
+// Serve exposes the counters over http until ctx is done
+func (mon *SentinelMonitor) Serve(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", mon.StatsHandler())
+	mux.Handle("/metrics", mon.MetricsHandler())
+	for pattern, handler := range mon.handlers {
+		mux.Handle(pattern, handler)
+	}
+	addr := mon.Addr
+	if addr == "" {
+		addr = ":8000"
+	}
+	server := &http.Server{Addr: addr, Handler: mux}
 
-	http.HandleFunc("/", statsHandler)
-	return http.ListenAndServe(":8000", nil)
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close flushes and releases the counter store
+func (mon *SentinelMonitor) Close() error {
+	return mon.Stats.Close()
+}
+
+func newSentinelMonitor(stats *utils.SentinelCounters) *SentinelMonitor {
+	mon := &SentinelMonitor{
+		Stats:    *stats,
+		Addr:     ":8000",
+		registry: prometheus.NewRegistry(),
+		latency:  newLatency(),
+	}
+	mon.registry.MustRegister(counterCollector{mon}, mon.latency)
+	return mon
 }
 
 func NewSentinelMonitor(monitorName string) *SentinelMonitor {
-	return &SentinelMonitor{
-		Stats: *utils.NewSentinelCounter(monitorName, false),
+	mon := newSentinelMonitor(utils.NewSentinelCounter(monitorName, false))
+	mon.registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	// counters written by older versions are moved to their registered names
+	migrated, err := mon.Migrate()
+	if err != nil {
+		log.Error(err)
+	} else if migrated > 0 {
+		log.Info(fmt.Sprintf("Migrated %d counters to their registered names", migrated))
 	}
+	return mon
+}
+
+func NewTestSentinelMonitor(monitorName string) *SentinelMonitor {
+	return newSentinelMonitor(utils.NewTestSentinelCounter(monitorName))
 }
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	certstreamorc "github.com/gakiwate/sentinel-orchestra/certstream-orchestra"
+	ctlogorc "github.com/gakiwate/sentinel-orchestra/ctlog-orchestra"
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
 	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
 	sentinelmon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	sentinelpsl "github.com/gakiwate/sentinel-orchestra/sentinel-psl"
+	sentinelquarantine "github.com/gakiwate/sentinel-orchestra/sentinel-quarantine"
+	sentinelscheduler "github.com/gakiwate/sentinel-orchestra/sentinel-scheduler"
+	sentinelsup "github.com/gakiwate/sentinel-orchestra/sentinel-supervisor"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
 	zdnsorc "github.com/gakiwate/sentinel-orchestra/zdns-orchestra"
 	zgraborc "github.com/gakiwate/sentinel-orchestra/zgrab-orchestra"
 	log "github.com/sirupsen/logrus"
@@ -15,27 +25,136 @@ import (
 )
 
 type Config struct {
+	Broker struct {
+		Type         string `default:"nsq" yaml:"type"`
+		NSQDPort     int    `default:"4150" yaml:"nsqd_port"`
+		LookupdPort  int    `default:"4161" yaml:"lookupd_port"`
+		NSQDHTTPPort int    `default:"4151" yaml:"nsqd_http_port"`
+	} `yaml:"broker"`
 	Certstream struct {
-		Enable bool     `default:"false" yaml:"enable"`
-		Topics []string `yaml:"topics"`
+		Enable                         bool     `default:"false" yaml:"enable"`
+		Topics                         []string `yaml:"topics"`
+		certstreamorc.CertstreamConfig `yaml:",inline"`
 	} `yaml:"certstream"`
+	CTLog struct {
+		Enable                     bool `default:"false" yaml:"enable"`
+		ctlogorc.CTLogPollerConfig `yaml:",inline"`
+	} `yaml:"ctlog"`
 	ZDNS struct {
-		Enable bool     `default:"false" yaml:"enable"`
-		Ipv4   bool     `yaml:"ipv4"`
-		Ipv6   bool     `yaml:"ipv6"`
-		Topics []string `yaml:"topics"`
+		Enable      bool                        `default:"false" yaml:"enable"`
+		Ipv4        bool                        `yaml:"ipv4"`
+		Ipv6        bool                        `yaml:"ipv6"`
+		ZGrabTopic  string                      `default:"zgrab" yaml:"zgrab_topic"`
+		ZGrabPolicy string                      `default:"all" yaml:"zgrab_policy"`
+		Retry       zdnsorc.ZDNSRetryPolicy     `yaml:"retry"`
+		Stages      []zdnsorc.SentinelZDNSStage `yaml:"stages"`
 	} `yaml:"zdns"`
 	ZGrab struct {
-		Enable bool     `default:"false" yaml:"enable"`
-		Topics []string `yaml:"topics"`
+		Enable bool                          `default:"false" yaml:"enable"`
+		Stages []zgraborc.SentinelZGrabStage `yaml:"stages"`
 	} `yaml:"zgrab"`
 	Monitor struct {
 		StoragePath string `default:"." yaml:"storage"`
 		Name        string `default:"sentinel-stats" yaml:"name"`
+		Listen      string `default:":8000" yaml:"listen"`
+		// Retention is how long the per minute, hour and day counts are kept
+		Retention utils.SentinelCountersRetention `yaml:"retention"`
 	} `yaml:"monitor"`
 	DataStore struct {
 		StoragePath string `default:"." yaml:"storage"`
 	}
+	Scheduler  sentinelscheduler.SentinelSchedulerConfig   `yaml:"scheduler"`
+	Quarantine sentinelquarantine.SentinelQuarantineConfig `yaml:"quarantine"`
+	PSL        struct {
+		Path string `yaml:"path"`
+	} `yaml:"psl"`
+}
+
+func readConfig() Config {
+	// Use configuration file to determine which programs to run
+	configData, err := os.ReadFile("config.yaml")
+	if err != nil {
+		log.Fatalf("Failed to read config file: %v", err)
+	}
+
+	var config Config
+	err = yaml.Unmarshal(configData, &config)
+	if err != nil {
+		log.Fatalf("Failed to parse config file: %v", err)
+	}
+	return config
+}
+
+func newBroker(config Config, nsqHost string) sentinelbroker.Broker {
+	switch config.Broker.Type {
+	case "", "nsq":
+		nsqCfg := sentinelbroker.NSQBrokerConfig{
+			Host:         nsqHost,
+			NSQDPort:     config.Broker.NSQDPort,
+			LookupdPort:  config.Broker.LookupdPort,
+			NSQDHTTPPort: config.Broker.NSQDHTTPPort,
+		}
+		// let the quarantine decide when to give up on a message
+		if config.Quarantine.Enable {
+			nsqCfg.MaxAttempts = config.Quarantine.MaxAttempts
+		}
+		broker, err := sentinelbroker.NewNSQBroker(nsqCfg)
+		if err != nil {
+			log.Fatalf("Failed to create nsq broker: %v", err)
+		}
+		return broker
+	case "memory":
+		return sentinelbroker.NewMemoryBroker()
+	default:
+		log.Fatalf("Unknown broker type: %s", config.Broker.Type)
+	}
+	return nil
+}
+
+func newDataStore(config Config) *sentineldb.SentinelDB {
+	dbName := fmt.Sprintf("%s/%s", config.DataStore.StoragePath, "sentinel-data")
+	return sentineldb.NewSentinelDB(dbName, false)
+}
+
+func newMonitor(config Config) *sentinelmon.SentinelMonitor {
+	monitorName := fmt.Sprintf("%s/%s", config.Monitor.StoragePath, config.Monitor.Name)
+	monitor := sentinelmon.NewSentinelMonitor(monitorName)
+	if config.Monitor.Listen != "" {
+		monitor.Addr = config.Monitor.Listen
+	}
+	monitor.Stats.SetRetention(config.Monitor.Retention)
+	return monitor
+}
+
+// topics returns every topic the pipeline publishes on
+func topics(config Config) []string {
+	seen := make(map[string]bool)
+	all := []string{}
+	add := func(topic string) {
+		if topic != "" && !seen[topic] {
+			seen[topic] = true
+			all = append(all, topic)
+		}
+	}
+	if len(config.Certstream.Topics) > 0 {
+		add(config.Certstream.Topics[0])
+	}
+	for _, stage := range config.ZDNS.Stages {
+		add(stage.InTopic)
+		add(stage.OutTopic)
+	}
+	if config.ZDNS.ZGrabTopic == "" {
+		add("zgrab")
+	}
+	add(config.ZDNS.ZGrabTopic)
+	for _, stage := range config.ZGrab.Stages {
+		add(stage.InTopic)
+		add(stage.OutTopic)
+	}
+	if config.Quarantine.Enable {
+		add(config.Quarantine.Topic)
+	}
+	return all
 }
 
 func main() {
@@ -53,73 +172,133 @@ func main() {
 		},
 	}
 
-	rootCmd.Flags().StringVar(&nsqHost, "nsq-host", "localhost", "IP address of machine running nslookupd")
+	rootCmd.PersistentFlags().StringVar(&nsqHost, "nsq-host", "localhost", "IP address of machine running nslookupd")
 	rootCmd.Flags().StringVar(&nsqOutTopic, "nsq-topic", "zdns", "The NSQ topic to publish on")
 
 	// Set Logger Level
 	log.SetLevel(log.ErrorLevel)
 
-	if err := rootCmd.Execute(); err != nil {
+	rootCmd.AddCommand(newQuarantineCmd(&nsqHost))
+
+	cmd, err := rootCmd.ExecuteC()
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	if rootCmd.Flags().Changed("help") {
+	if cmd != rootCmd || rootCmd.Flags().Changed("help") {
 		return
 	}
 
-	// Use configuration file to determine which programs to run
-	configData, err := os.ReadFile("config.yaml")
-	if err != nil {
-		log.Fatalf("Failed to read config file: %v", err)
-	}
+	config := readConfig()
 
-	var config Config
-	err = yaml.Unmarshal(configData, &config)
-	if err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+	// Replace the embedded public suffix list with a newer download
+	if config.PSL.Path != "" {
+		list, err := sentinelpsl.LoadFile(config.PSL.Path)
+		if err != nil {
+			log.Fatalf("Failed to load public suffix list: %v", err)
+		}
+		sentinelpsl.SetDefault(list)
 	}
 
-	monitorName := fmt.Sprintf("%s/%s", config.Monitor.StoragePath, config.Monitor.Name)
-	monitor := sentinelmon.NewSentinelMonitor(monitorName)
+	monitor := newMonitor(config)
 	log.Info("Created the monitor")
 
-	dbName := fmt.Sprintf("%s/%s", config.DataStore.StoragePath, "sentinel-data")
-	db := sentineldb.NewSentinelDB(dbName, false)
+	broker := newBroker(config, nsqHost)
+	log.Info("Created the broker")
+	if depthBroker, ok := broker.(sentinelbroker.DepthBroker); ok {
+		monitor.QueueDepth(topics(config), depthBroker.TopicDepth)
+	}
+
+	db := newDataStore(config)
 	log.Info("Created Data Store")
 
-	if config.Certstream.Enable {
-		certstreamOrchestrator := certstreamorc.NewSentinelCertstreamOrchestrator(db, monitor, nsqHost, config.Certstream.Topics[0])
-		go certstreamOrchestrator.Run()
+	monitor.Handle("/registrable", sentinelpsl.Handler(db))
+	monitor.Handle("/changes", zdnsorc.ChangesHandler(db))
+
+	supervisor := sentinelsup.NewSentinelSupervisor()
+	supervisor.Add("monitor", monitor.Serve)
+	supervisor.Add("counters", monitor.Stats.Run)
+
+	// Hold delayed scans in the data store instead of relying on the broker
+	// and the workers to keep them until scan_after
+	if config.Scheduler.Enable {
+		scheduler := sentinelscheduler.NewSentinelScheduler(db, monitor, broker, config.Scheduler)
+		monitor.Handle("/scheduler", scheduler.Handler())
+		monitor.Gauge("sentinel_scheduler_backlog", "Scans held until their scan_after", func() float64 {
+			return float64(scheduler.Backlog())
+		})
+		monitor.Gauge("sentinel_scheduler_overdue", "Held scans past their scan_after", func() float64 {
+			return float64(scheduler.Overdue())
+		})
+		supervisor.Add("scheduler", scheduler.Run)
+		broker = scheduler
+	}
+
+	// Move messages the orchestrators keep failing on out of the way
+	if config.Quarantine.Enable {
+		broker = sentinelquarantine.NewSentinelQuarantine(db, monitor, broker, config.Quarantine)
+	}
+
+	// The CT log poller hands its entries to the certstream orchestrator so
+	// both sources are processed the same way
+	if config.Certstream.Enable || config.CTLog.Enable {
+		if len(config.Certstream.Topics) == 0 {
+			log.Fatalf("Failed to configure certstream: certstream.topics is empty")
+		}
+		certstreamOrchestrator := certstreamorc.NewSentinelCertstreamOrchestrator(db, monitor, broker, config.Certstream.Topics[0], config.Certstream.CertstreamConfig)
+		supervisor.Add("certstream-sweep", certstreamOrchestrator.Sweep)
+		if config.Certstream.Enable {
+			supervisor.Add("certstream", certstreamOrchestrator.Run)
+		}
+		if config.CTLog.Enable {
+			ctlogOrchestrator := ctlogorc.NewSentinelCTLogOrchestrator(db, monitor, certstreamOrchestrator, config.CTLog.CTLogPollerConfig)
+			supervisor.Add("ctlog", ctlogOrchestrator.Run)
+		}
 	}
-	log.Info("Launched certstream orchestrator")
 
 	if config.ZDNS.Enable {
 		ipv4 := config.ZDNS.Ipv4
 		ipv6 := config.ZDNS.Ipv6
-		for _, topic := range config.ZDNS.Topics {
-			if topic == "zdns_4hr" {
-				zdnsOrchestrator_4hr := zdnsorc.NewSentinelZDNS4hrDelayOrchestrator(db, monitor, nsqHost, ipv4, ipv6)
-				go zdnsOrchestrator_4hr.FeedBroker()
-			}
-			if topic == "zdns_8hr" {
-				zdnsOrchestrator_8hr := zdnsorc.NewSentinelZDNS8hrDelayOrchestrator(db, monitor, nsqHost, ipv4, ipv6)
-				go zdnsOrchestrator_8hr.FeedBroker()
-			}
+		zgrabTopic := config.ZDNS.ZGrabTopic
+		if zgrabTopic == "" {
+			zgrabTopic = "zgrab"
+		}
+		zdnsOrchestrators, err := zdnsorc.NewSentinelZDNSStageOrchestrators(db, monitor, broker, ipv4, ipv6, zgrabTopic, config.ZDNS.ZGrabPolicy, config.ZDNS.Retry, config.ZDNS.Stages)
+		if err != nil {
+			log.Fatalf("Failed to configure zdns stages: %v", err)
+		}
+		for _, zdnsOrchestrator := range zdnsOrchestrators {
+			supervisor.Add(fmt.Sprintf("zdns-%s", zdnsOrchestrator.Name()), zdnsOrchestrator.FeedBroker)
 		}
 	}
 
 	if config.ZGrab.Enable {
-		for _, topic := range config.ZGrab.Topics {
-			if topic == "zgrab_4hr" {
-				zgrabOrchestrator_4hr := zgraborc.NewSentinelZgrab4hrDelayOrchestrator(monitor, nsqHost)
-				go zgrabOrchestrator_4hr.FeedBroker()
-			}
-			if topic == "zgrab_8hr" {
-				zgrabOrchestrator_8hr := zgraborc.NewSentinelZgrab8hrDelayOrchestrator(monitor, nsqHost)
-				go zgrabOrchestrator_8hr.FeedBroker()
-			}
+		zgrabOrchestrators, err := zgraborc.NewSentinelZGrabStageOrchestrators(db, monitor, broker, config.ZGrab.Stages)
+		if err != nil {
+			log.Fatalf("Failed to configure zgrab stages: %v", err)
 		}
+		for _, zgrabOrchestrator := range zgrabOrchestrators {
+			supervisor.Add(fmt.Sprintf("zgrab-%s", zgrabOrchestrator.Name()), zgrabOrchestrator.FeedBroker)
+		}
+	}
+
+	if config.ZDNS.Enable || config.ZGrab.Enable {
+		supervisor.Add("zgrab-chain-sweep", func(ctx context.Context) error {
+			return zgraborc.SweepChains(ctx, db, monitor)
+		})
 	}
 
-	log.Fatal(monitor.Serve())
+	// Stop consuming before closing the stores the handlers write to
+	supervisor.AddCloser("broker", func() error {
+		broker.Stop()
+		return nil
+	})
+	supervisor.AddCloser("datastore", db.Close)
+	supervisor.AddCloser("monitor", monitor.Close)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := supervisor.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,80 @@
+package sentinelpsl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+)
+
+// Sources indexed by registrable domain
+var Sources = []string{"certstream", "zdns", "zgrab"}
+
+// IndexKey returns the key grouping the records of source for the
+// registrable domain
+func IndexKey(source string, registrable string) string {
+	return fmt.Sprintf("registrable|%s|%s", registrable, source)
+}
+
+// Index appends the record of a domain to its registrable domain's index and
+// counts it per source. Domains without a registrable domain are only counted.
+func Index(db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor, source string, domain string, record []byte) error {
+	registrable, err := Registrable(domain)
+	if err != nil {
+		monitor.Incr(mon.RegistrableUnknown, source)
+		return nil
+	}
+	monitor.Incr(mon.RegistrableRecords, source)
+	return db.AddResult(IndexKey(source, registrable), record)
+}
+
+// SentinelRegistrableRecords is the /registrable response
+type SentinelRegistrableRecords struct {
+	Registrable string                       `json:"registrable"`
+	Records     map[string][]json.RawMessage `json:"records"`
+}
+
+// Lookup returns every indexed record of the registrable domain of domain
+func Lookup(db *sentineldb.SentinelDB, domain string) (SentinelRegistrableRecords, error) {
+	registrable, err := Registrable(domain)
+	if err != nil {
+		return SentinelRegistrableRecords{}, err
+	}
+	result := SentinelRegistrableRecords{
+		Registrable: registrable,
+		Records:     make(map[string][]json.RawMessage),
+	}
+	for _, source := range Sources {
+		records := []json.RawMessage{}
+		value, _ := db.Get(IndexKey(source, registrable))
+		for _, line := range bytes.Split(value, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				records = append(records, json.RawMessage(line))
+			}
+		}
+		result.Records[source] = records
+	}
+	return result, nil
+}
+
+// Handler serves /registrable?domain=<domain>
+func Handler(db *sentineldb.SentinelDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := Lookup(db, r.URL.Query().Get("domain"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jsonData, err := json.Marshal(result)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonData)
+	}
+}
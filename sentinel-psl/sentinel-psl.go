@@ -0,0 +1,161 @@
+package sentinelpsl
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/idna"
+)
+
+// The list is a copy of https://publicsuffix.org/list/public_suffix_list.dat.
+// Replace the file to update the embedded copy, or point psl.path in the
+// config at a newer download.
+//
+//go:embed public_suffix_list.dat
+var embedded []byte
+
+// List is a parsed public suffix list. Both the ICANN and the private
+// sections are used.
+type List struct {
+	rules      map[string]bool
+	wildcards  map[string]bool
+	exceptions map[string]bool
+}
+
+var (
+	mu      sync.RWMutex
+	current *List
+)
+
+// Parse reads a list in the publicsuffix.org format
+func Parse(r io.Reader) (*List, error) {
+	l := &List{
+		rules:      make(map[string]bool),
+		wildcards:  make(map[string]bool),
+		exceptions: make(map[string]bool),
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		// rules end at the first whitespace
+		line = strings.Fields(line)[0]
+
+		rules := l.rules
+		if strings.HasPrefix(line, "!") {
+			rules = l.exceptions
+			line = line[1:]
+		} else if strings.HasPrefix(line, "*.") {
+			rules = l.wildcards
+			line = line[2:]
+		}
+		// certificates carry names in punycode
+		rule, err := idna.ToASCII(line)
+		if err != nil {
+			return nil, fmt.Errorf("psl: rule %s: %w", line, err)
+		}
+		rules[strings.ToLower(rule)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(l.rules) == 0 {
+		return nil, fmt.Errorf("psl: no rules found")
+	}
+	return l, nil
+}
+
+// LoadFile reads a list from disk
+func LoadFile(path string) (*List, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Default returns the list used by the package level functions. Unless
+// SetDefault was called this is the embedded list.
+func Default() *List {
+	mu.RLock()
+	l := current
+	mu.RUnlock()
+	if l != nil {
+		return l
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		parsed, err := Parse(bytes.NewReader(embedded))
+		if err != nil {
+			panic(err)
+		}
+		current = parsed
+	}
+	return current
+}
+
+// SetDefault replaces the list used by the package level functions
+func SetDefault(l *List) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = l
+}
+
+func normalize(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	return strings.TrimPrefix(domain, "*.")
+}
+
+// PublicSuffix returns the public suffix of the domain. Names without a
+// matching rule fall back to their last label.
+func (l *List) PublicSuffix(domain string) string {
+	labels := strings.Split(normalize(domain), ".")
+	for i := range labels {
+		name := strings.Join(labels[i:], ".")
+		if l.exceptions[name] {
+			return strings.Join(labels[i+1:], ".")
+		}
+		if l.rules[name] {
+			return name
+		}
+		if i+1 < len(labels) && l.wildcards[strings.Join(labels[i+1:], ".")] {
+			return name
+		}
+	}
+	return labels[len(labels)-1]
+}
+
+// Registrable returns the eTLD+1 of the domain
+func (l *List) Registrable(domain string) (string, error) {
+	domain = normalize(domain)
+	if domain == "" || strings.Contains(domain, "..") {
+		return "", fmt.Errorf("psl: invalid domain %q", domain)
+	}
+	suffix := l.PublicSuffix(domain)
+	if domain == suffix {
+		return "", fmt.Errorf("psl: %s is a public suffix", domain)
+	}
+	rest := strings.TrimSuffix(domain, "."+suffix)
+	return rest[strings.LastIndex(rest, ".")+1:] + "." + suffix, nil
+}
+
+// PublicSuffix returns the public suffix of the domain using the default list
+func PublicSuffix(domain string) string {
+	return Default().PublicSuffix(domain)
+}
+
+// Registrable returns the eTLD+1 of the domain using the default list
+func Registrable(domain string) (string, error) {
+	return Default().Registrable(domain)
+}
@@ -0,0 +1,98 @@
+package sentinelpsl
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+)
+
+func TestRegistrable(t *testing.T) {
+	tests := []struct {
+		domain      string
+		registrable string
+	}{
+		{"www.example.com", "example.com"},
+		{"a.b.example.co.uk", "example.co.uk"},
+		{"*.example.com", "example.com"},
+		{"WWW.Example.COM.", "example.com"},
+		// wildcard and exception rules: *.ck and !www.ck
+		{"a.b.c.ck", "b.c.ck"},
+		{"a.www.ck", "www.ck"},
+		// private section
+		{"foo.blogspot.com", "foo.blogspot.com"},
+		// unicode rules are matched in punycode
+		{"www.example.xn--fiqs8s", "example.xn--fiqs8s"},
+		// unknown TLDs fall back to the last label
+		{"a.valid.domain", "valid.domain"},
+	}
+	for _, test := range tests {
+		registrable, err := Registrable(test.domain)
+		if err != nil || registrable != test.registrable {
+			t.Errorf("%s: expected %s but got %s (%v)", test.domain, test.registrable, registrable, err)
+		}
+	}
+
+	for _, domain := range []string{"com", "co.uk", "", "a..com"} {
+		if registrable, err := Registrable(domain); err == nil {
+			t.Errorf("%s: expected an error but got %s", domain, registrable)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	list, err := Parse(strings.NewReader("// comment\n\nexample\n*.wild.example\n!keep.wild.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"a.b.example":         "b.example",
+		"a.b.wild.example":    "a.b.wild.example",
+		"a.keep.wild.example": "keep.wild.example",
+	}
+	for domain, expected := range tests {
+		if registrable, _ := list.Registrable(domain); registrable != expected {
+			t.Errorf("%s: expected %s but got %s", domain, expected, registrable)
+		}
+	}
+
+	if _, err := Parse(strings.NewReader("// only comments\n")); err == nil {
+		t.Errorf("Expected an error for an empty list")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	db := sentineldb.NewTestSentinelDB("sentinel-psl-test")
+	monitor := mon.NewTestSentinelMonitor("sentinel-psl-test-stats")
+
+	Index(db, monitor, "zdns", "www.example.co.uk", []byte(`{"domain": "www.example.co.uk"}`))
+	Index(db, monitor, "zdns", "mail.example.co.uk", []byte(`{"domain": "mail.example.co.uk"}`))
+	Index(db, monitor, "zgrab", "www.example.co.uk", []byte(`{"domain": "www.example.co.uk"}`))
+	Index(db, monitor, "zdns", "co.uk", []byte(`{"domain": "co.uk"}`))
+
+	cnt := monitor.Count(mon.RegistrableRecords, "zdns")
+	unknown := monitor.Count(mon.RegistrableUnknown, "zdns")
+	if cnt != 2 || unknown != 1 {
+		t.Errorf("Expected 2 zdns results and 1 unknown but got %d and %d", cnt, unknown)
+	}
+
+	w := httptest.NewRecorder()
+	Handler(db)(w, httptest.NewRequest("GET", "/registrable?domain=example.co.uk", nil))
+	var result SentinelRegistrableRecords
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Unable to read %s: %s", w.Body.Bytes(), err)
+	}
+	if result.Registrable != "example.co.uk" || len(result.Records["zdns"]) != 2 ||
+		len(result.Records["zgrab"]) != 1 || len(result.Records["certstream"]) != 0 {
+		t.Errorf("Unexpected records %+v", result)
+	}
+
+	w = httptest.NewRecorder()
+	Handler(db)(w, httptest.NewRequest("GET", "/registrable?domain=co.uk", nil))
+	if w.Code != 400 {
+		t.Errorf("Expected 400 for a public suffix but got %d", w.Code)
+	}
+}
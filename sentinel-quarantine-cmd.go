@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	sentinelquarantine "github.com/gakiwate/sentinel-orchestra/sentinel-quarantine"
+	"github.com/spf13/cobra"
+)
+
+// newQuarantineCmd manages the quarantined messages. It opens the data store,
+// so the orchestrator has to be stopped first.
+func newQuarantineCmd(nsqHost *string) *cobra.Command {
+	quarantineCmd := &cobra.Command{
+		Use:   "quarantine",
+		Short: "List, inspect and replay quarantined messages",
+	}
+
+	var topic string
+	var limit int
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List quarantined messages, oldest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db := newDataStore(readConfig())
+			defer db.Close()
+			for _, record := range sentinelquarantine.List(db, topic, limit) {
+				fmt.Printf("%s\t%s\t%d\t%s\t%s\n", record.ID, record.Topic, record.Attempts, record.Quarantined, record.Error)
+			}
+			return nil
+		},
+	}
+	listCmd.Flags().StringVar(&topic, "topic", "", "Only list messages of this topic")
+	listCmd.Flags().IntVar(&limit, "limit", 100, "Maximum number of messages to list, 0 lists all")
+
+	inspectCmd := &cobra.Command{
+		Use:   "inspect <id>",
+		Short: "Show a quarantined message",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db := newDataStore(readConfig())
+			defer db.Close()
+			record, err := sentinelquarantine.Inspect(db, args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("id:          %s\n", record.ID)
+			fmt.Printf("topic:       %s\n", record.Topic)
+			fmt.Printf("channel:     %s\n", record.Channel)
+			fmt.Printf("attempts:    %d\n", record.Attempts)
+			fmt.Printf("quarantined: %s\n", record.Quarantined)
+			fmt.Printf("error:       %s\n", record.Error)
+			fmt.Printf("body:\n%s\n", record.Body)
+			return nil
+		},
+	}
+
+	var all bool
+	replayCmd := &cobra.Command{
+		Use:   "replay [<id>...]",
+		Short: "Publish quarantined messages on their topic again",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if all == (len(args) > 0) {
+				return fmt.Errorf("give either message ids or --all")
+			}
+			config := readConfig()
+			db := newDataStore(config)
+			defer db.Close()
+			monitor := newMonitor(config)
+			defer monitor.Close()
+			broker := newBroker(config, *nsqHost)
+			defer broker.Stop()
+
+			ids := args
+			if all {
+				for _, record := range sentinelquarantine.List(db, topic, 0) {
+					ids = append(ids, record.ID)
+				}
+			}
+			for _, id := range ids {
+				if err := sentinelquarantine.Replay(db, monitor, broker, id); err != nil {
+					return err
+				}
+				fmt.Printf("Replayed %s\n", id)
+			}
+			return nil
+		},
+	}
+	replayCmd.Flags().BoolVar(&all, "all", false, "Replay every quarantined message")
+	replayCmd.Flags().StringVar(&topic, "topic", "", "With --all, only replay messages of this topic")
+
+	quarantineCmd.AddCommand(listCmd, inspectCmd, replayCmd)
+	return quarantineCmd
+}
@@ -0,0 +1,159 @@
+package sentinelquarantine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const quarantinePrefix = "quarantine|"
+
+type SentinelQuarantineConfig struct {
+	Enable bool `yaml:"enable"`
+	// MaxAttempts is how often a message is handled before it is quarantined
+	MaxAttempts uint16 `yaml:"max_attempts"`
+	// Topic receives a copy of every quarantined message
+	Topic string `yaml:"topic"`
+}
+
+// SentinelDBQuarantined is a message that kept failing, stored under
+// quarantine|<id> and published on the dead-letter topic
+type SentinelDBQuarantined struct {
+	ID          string `json:"id"`
+	Topic       string `json:"topic"`
+	Channel     string `json:"channel"`
+	Body        []byte `json:"body"`
+	Error       string `json:"error"`
+	Attempts    uint16 `json:"attempts"`
+	Quarantined string `json:"quarantined"`
+}
+
+// SentinelQuarantine is a Broker whose subscribers give up on a message after
+// MaxAttempts failed attempts. Instead of being requeued forever the message
+// is moved to the quarantine, where it can be inspected and replayed.
+type SentinelQuarantine struct {
+	sentinelbroker.Broker
+	db      *sentineldb.SentinelDB
+	monitor *mon.SentinelMonitor
+	cfg     SentinelQuarantineConfig
+	clock   utils.Clock
+	seq     uint64
+}
+
+func NewSentinelQuarantine(db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor, broker sentinelbroker.Broker, cfg SentinelQuarantineConfig) *SentinelQuarantine {
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = "sentinel_dead_letter"
+	}
+	return &SentinelQuarantine{
+		Broker:  broker,
+		db:      db,
+		monitor: monitor,
+		cfg:     cfg,
+		clock:   utils.RealClock{},
+	}
+}
+
+// SetClock replaces the clock used to timestamp quarantined messages
+func (q *SentinelQuarantine) SetClock(clock utils.Clock) {
+	q.clock = clock
+}
+
+func quarantineKey(id string) string {
+	return quarantinePrefix + id
+}
+
+// Subscribe delivers the messages of topic to handler and quarantines the
+// ones handler fails on MaxAttempts times
+func (q *SentinelQuarantine) Subscribe(topic string, channel string, handler sentinelbroker.Handler) error {
+	return q.Broker.Subscribe(topic, channel, func(m *sentinelbroker.Message) error {
+		err := handler(m)
+		if err == nil || m.Attempts < q.cfg.MaxAttempts {
+			return err
+		}
+		if qerr := q.quarantine(m, channel, err); qerr != nil {
+			log.Error(qerr)
+			// keep the message on the broker rather than losing it
+			return err
+		}
+		return nil
+	})
+}
+
+func (q *SentinelQuarantine) quarantine(m *sentinelbroker.Message, channel string, cause error) error {
+	now := q.clock.Now()
+	record := SentinelDBQuarantined{
+		ID:          fmt.Sprintf("%020d-%06d", now.UnixNano(), atomic.AddUint64(&q.seq, 1)%1000000),
+		Topic:       m.Topic,
+		Channel:     channel,
+		Body:        m.Body,
+		Error:       cause.Error(),
+		Attempts:    m.Attempts,
+		Quarantined: now.UTC().Format(time.RFC3339),
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := q.db.Set(quarantineKey(record.ID), value); err != nil {
+		return err
+	}
+	if err := q.Broker.Publish(q.cfg.Topic, value); err != nil {
+		log.Error(err)
+	}
+	q.monitor.Incr(mon.QuarantineMessages, m.Topic)
+	log.Error(fmt.Sprintf("Quarantined %s from %s after %d attempts: %s", record.ID, m.Topic, m.Attempts, cause))
+	return nil
+}
+
+// List returns up to limit quarantined messages of topic, or of every topic
+// if topic is empty, oldest first
+func List(db *sentineldb.SentinelDB, topic string, limit int) []SentinelDBQuarantined {
+	records := []SentinelDBQuarantined{}
+	iter := db.FetchAllKeysIterator([]byte(quarantinePrefix))
+	defer iter.Close()
+	for iter.First(); iter.Valid() && (limit <= 0 || len(records) < limit); iter.Next() {
+		var record SentinelDBQuarantined
+		if json.Unmarshal(iter.Value(), &record) != nil {
+			continue
+		}
+		if topic == "" || record.Topic == topic {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// Inspect returns the quarantined message id
+func Inspect(db *sentineldb.SentinelDB, id string) (SentinelDBQuarantined, error) {
+	var record SentinelDBQuarantined
+	value, _ := db.Get(quarantineKey(id))
+	if len(value) == 0 {
+		return record, fmt.Errorf("quarantine: no message %s", id)
+	}
+	err := json.Unmarshal(value, &record)
+	return record, err
+}
+
+// Replay publishes the quarantined message id on its topic again and removes
+// it from the quarantine
+func Replay(db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor, broker sentinelbroker.Broker, id string) error {
+	record, err := Inspect(db, id)
+	if err != nil {
+		return err
+	}
+	if err := broker.Publish(record.Topic, record.Body); err != nil {
+		return err
+	}
+	monitor.Incr(mon.QuarantineReplayed)
+	return db.Delete(quarantineKey(id))
+}
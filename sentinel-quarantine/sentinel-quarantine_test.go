@@ -0,0 +1,71 @@
+package sentinelquarantine
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+)
+
+func TestQuarantine(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	broker.RequeueDelay = 0
+	defer broker.Stop()
+	db := sentineldb.NewTestSentinelDB("sentinel-quarantine-test")
+	monitor := mon.NewTestSentinelMonitor("sentinel-quarantine-test-stats")
+	q := NewSentinelQuarantine(db, monitor, broker, SentinelQuarantineConfig{MaxAttempts: 3})
+	q.SetClock(utils.NewFakeClock(time.Unix(1677664800, 0)))
+
+	var mu sync.Mutex
+	handled := []string{}
+	q.Subscribe("zdns_results", "orchestrator", func(m *sentinelbroker.Message) error {
+		var result schema.ZDNSResult
+		if err := schema.Unmarshal(m.Body, &result); err != nil {
+			return err
+		}
+		mu.Lock()
+		handled = append(handled, result.Data.Name)
+		mu.Unlock()
+		return nil
+	})
+	q.Publish("zdns_results", []byte(`{"data": {"name": "a.valid.domain"}, "status": "NOERROR"}`))
+	q.Publish("zdns_results", []byte(`{"data": `))
+	broker.WaitIdle()
+
+	if len(handled) != 1 || broker.Depth("sentinel_dead_letter") != 1 {
+		t.Fatalf("Expected 1 handled and 1 dead-lettered message but got %v and %d", handled, broker.Depth("sentinel_dead_letter"))
+	}
+	records := List(db, "zdns_results", 0)
+	if len(records) != 1 || string(records[0].Body) != `{"data": ` || records[0].Attempts != 3 || records[0].Error == "" {
+		t.Fatalf("Unexpected quarantine %+v", records)
+	}
+	if len(List(db, "zgrab_results", 0)) != 0 {
+		t.Errorf("Expected no quarantined zgrab results")
+	}
+	cnt := monitor.Count(mon.QuarantineMessages, "zdns_results")
+	if cnt != 1 {
+		t.Errorf("Expected quarantine count 1 but got %d", cnt)
+	}
+
+	record, err := Inspect(db, records[0].ID)
+	if err != nil || record.Channel != "orchestrator" {
+		t.Errorf("Unexpected record %+v (%v)", record, err)
+	}
+	if err := Replay(db, monitor, broker, records[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	broker.WaitIdle()
+	// the replayed message fails again and comes back under a new id
+	records = List(db, "", 0)
+	if len(records) != 1 || records[0].ID == record.ID {
+		t.Errorf("Expected the replayed message to be quarantined again but got %+v", records)
+	}
+	if _, err := Inspect(db, record.ID); err == nil {
+		t.Errorf("Expected %s to be removed by the replay", record.ID)
+	}
+}
@@ -0,0 +1,265 @@
+package sentinelscheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const schedulePrefix = "schedule|"
+
+type SentinelSchedulerConfig struct {
+	Enable bool `yaml:"enable"`
+	// PollInterval is how often the schedule is checked for due messages
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// MaxRate limits the messages published per second, 0 is unlimited.
+	// Messages over the limit wait in the schedule.
+	MaxRate float64 `yaml:"max_rate"`
+}
+
+// scheduledMessage is stored under schedule|<due>|<sequence>
+type scheduledMessage struct {
+	Topic string `json:"topic"`
+	Body  []byte `json:"body"`
+}
+
+// SentinelScheduler is a Broker holding messages until their scan_after.
+// Messages are kept in the data store ordered by due time, so scheduled
+// scans survive restarts of the orchestrator and of nsqd. Messages without
+// metadata, and messages that are already due, go straight to the broker.
+type SentinelScheduler struct {
+	sentinelbroker.Broker
+	db      *sentineldb.SentinelDB
+	monitor *mon.SentinelMonitor
+	cfg     SentinelSchedulerConfig
+	clock   utils.Clock
+
+	seq     uint64
+	backlog int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewSentinelScheduler(db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor, broker sentinelbroker.Broker, cfg SentinelSchedulerConfig) *SentinelScheduler {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	s := &SentinelScheduler{
+		Broker:  broker,
+		db:      db,
+		monitor: monitor,
+		cfg:     cfg,
+		clock:   utils.RealClock{},
+		seq:     uint64(time.Now().UnixNano()),
+		tokens:  cfg.burst(),
+	}
+
+	// recover the schedule left by the previous run
+	iter := db.FetchAllKeysIterator([]byte(schedulePrefix))
+	for iter.First(); iter.Valid(); iter.Next() {
+		s.backlog++
+	}
+	if err := iter.Close(); err != nil {
+		log.Error(err)
+	}
+	return s
+}
+
+// SetClock replaces the clock used to decide what is due
+func (s *SentinelScheduler) SetClock(clock utils.Clock) {
+	s.clock = clock
+	s.last = clock.Now()
+}
+
+func scheduleKey(due int64, seq uint64) string {
+	return fmt.Sprintf("%s%020d|%020d", schedulePrefix, due, seq)
+}
+
+func keyDue(key []byte) (int64, error) {
+	fields := strings.Split(strings.TrimPrefix(string(key), schedulePrefix), "|")
+	return strconv.ParseInt(fields[0], 10, 64)
+}
+
+// scanAfter reads the scan_after of zdns and zgrab inputs
+func scanAfter(body []byte) (int64, bool) {
+	var input struct {
+		Metadata *schema.Metadata `json:"metadata"`
+	}
+	if err := json.Unmarshal(body, &input); err != nil || input.Metadata == nil || input.Metadata.ScanAfter == "" {
+		return 0, false
+	}
+	return input.Metadata.ScanAfterUnix(), true
+}
+
+// burst is how many tokens the rate limit holds. It is at least one, so a
+// rate below one message per second still publishes.
+func (cfg SentinelSchedulerConfig) burst() float64 {
+	return math.Max(1, cfg.MaxRate)
+}
+
+// take consumes one token of the rate limit
+func (s *SentinelScheduler) take() bool {
+	if s.cfg.MaxRate <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	if !s.last.IsZero() {
+		s.tokens = math.Min(s.cfg.burst(), s.tokens+now.Sub(s.last).Seconds()*s.cfg.MaxRate)
+	}
+	s.last = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// Publish sends due messages to the broker and schedules the rest
+func (s *SentinelScheduler) Publish(topic string, body []byte) error {
+	due, ok := scanAfter(body)
+	if !ok {
+		return s.Broker.Publish(topic, body)
+	}
+	if due <= s.clock.Now().Unix() && s.take() {
+		s.monitor.Incr(mon.SchedulerImmediate)
+		return s.Broker.Publish(topic, body)
+	}
+
+	value, err := json.Marshal(scheduledMessage{Topic: topic, Body: body})
+	if err != nil {
+		return err
+	}
+	if err := s.db.Set(scheduleKey(due, atomic.AddUint64(&s.seq, 1)), value); err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.backlog, 1)
+	s.monitor.Incr(mon.SchedulerScheduled)
+	return nil
+}
+
+// PublishDue publishes scheduled messages that are due, as far as the rate
+// limit allows, and returns how many were published
+func (s *SentinelScheduler) PublishDue() int {
+	now := s.clock.Now().Unix()
+	published := 0
+	iter := s.db.FetchAllKeysIterator([]byte(schedulePrefix))
+	defer func() {
+		if err := iter.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+	for iter.First(); iter.Valid(); iter.Next() {
+		due, err := keyDue(iter.Key())
+		if err != nil {
+			log.Error(fmt.Sprintf("Scheduler: invalid key %s", iter.Key()))
+			continue
+		}
+		// keys are ordered by due time
+		if due > now || !s.take() {
+			break
+		}
+
+		var message scheduledMessage
+		if err := json.Unmarshal(iter.Value(), &message); err != nil {
+			// unreadable entries are dropped
+			log.Error(err)
+			s.monitor.Incr(mon.SchedulerInvalid)
+			if err := s.db.Delete(string(iter.Key())); err == nil {
+				atomic.AddInt64(&s.backlog, -1)
+			}
+			continue
+		}
+		if err := s.Broker.Publish(message.Topic, message.Body); err != nil {
+			// keep it and try again on the next poll
+			s.monitor.Incr(mon.SchedulerPublishErrors)
+			log.Error(err)
+			break
+		}
+		if err := s.db.Delete(string(iter.Key())); err != nil {
+			log.Error(err)
+			break
+		}
+		atomic.AddInt64(&s.backlog, -1)
+		s.monitor.Incr(mon.SchedulerPublished)
+		s.monitor.IncrBy(mon.SchedulerLagSeconds, now-due)
+		published++
+	}
+	return published
+}
+
+// Backlog returns the number of scheduled messages
+func (s *SentinelScheduler) Backlog() int64 {
+	return atomic.LoadInt64(&s.backlog)
+}
+
+// Overdue returns the number of scheduled messages that are already due
+func (s *SentinelScheduler) Overdue() int64 {
+	now := s.clock.Now().Unix()
+	var overdue int64
+	iter := s.db.FetchAllKeysIterator([]byte(schedulePrefix))
+	for iter.First(); iter.Valid(); iter.Next() {
+		if due, err := keyDue(iter.Key()); err != nil || due > now {
+			break
+		}
+		overdue++
+	}
+	if err := iter.Close(); err != nil {
+		log.Error(err)
+	}
+	return overdue
+}
+
+// Run publishes due messages until ctx is done
+func (s *SentinelScheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			s.PublishDue()
+		}
+	}
+}
+
+// SentinelSchedulerStats is the /scheduler response
+type SentinelSchedulerStats struct {
+	Backlog int64 `json:"backlog"`
+	Overdue int64 `json:"overdue"`
+}
+
+// Handler serves the size of the schedule on /scheduler
+func (s *SentinelScheduler) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonData, err := json.Marshal(SentinelSchedulerStats{
+			Backlog: s.Backlog(),
+			Overdue: s.Overdue(),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonData)
+	}
+}
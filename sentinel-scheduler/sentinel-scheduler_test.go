@@ -0,0 +1,125 @@
+package sentinelscheduler
+
+import (
+	"testing"
+	"time"
+
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+)
+
+var testStart = time.Unix(1677664800, 0)
+
+func testInput(t *testing.T, domain string, scanAfter int64) []byte {
+	body, err := schema.Marshal(&schema.ZDNSInput{
+		Domain:   domain,
+		Metadata: schema.NewMetadata("abcdef", "", "PrecertLogEntry", scanAfter),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestSchedule(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	db := sentineldb.NewTestSentinelDB("sentinel-scheduler-test")
+	monitor := mon.NewTestSentinelMonitor("sentinel-scheduler-test-stats")
+	clock := utils.NewFakeClock(testStart)
+	s := NewSentinelScheduler(db, monitor, broker, SentinelSchedulerConfig{})
+	s.SetClock(clock)
+
+	s.Publish("zdns", testInput(t, "now.valid.domain", testStart.Unix()))
+	s.Publish("zdns_8hr", testInput(t, "late.valid.domain", testStart.Add(8*time.Hour).Unix()))
+	s.Publish("zdns_4hr", testInput(t, "soon.valid.domain", testStart.Add(4*time.Hour).Unix()))
+	s.Publish("certstream", []byte(`{"update_type": "PrecertLogEntry"}`))
+
+	if broker.Depth("zdns") != 1 || broker.Depth("certstream") != 1 || s.Backlog() != 2 {
+		t.Errorf("Expected 2 messages published and 2 scheduled but %d are scheduled", s.Backlog())
+	}
+
+	clock.Advance(4 * time.Hour)
+	if n := s.PublishDue(); n != 1 || broker.Depth("zdns_4hr") != 1 || broker.Depth("zdns_8hr") != 0 {
+		t.Errorf("Expected only the 4hr message to be due but published %d", n)
+	}
+
+	// the schedule survives a restart
+	restarted := NewSentinelScheduler(db, monitor, broker, SentinelSchedulerConfig{})
+	restarted.SetClock(clock)
+	if restarted.Backlog() != 1 {
+		t.Errorf("Expected 1 recovered message but got %d", restarted.Backlog())
+	}
+	clock.Advance(5 * time.Hour)
+	if restarted.Overdue() != 1 {
+		t.Errorf("Expected 1 overdue message but got %d", restarted.Overdue())
+	}
+	if n := restarted.PublishDue(); n != 1 || broker.Depth("zdns_8hr") != 1 || restarted.Backlog() != 0 {
+		t.Errorf("Expected the 8hr message to be published but published %d", n)
+	}
+
+	lag := monitor.Count(mon.SchedulerLagSeconds)
+	if lag != 3600 {
+		t.Errorf("Expected the 8hr message to be published an hour late but lag is %d", lag)
+	}
+}
+
+func TestMaxRate(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	db := sentineldb.NewTestSentinelDB("sentinel-scheduler-rate-test")
+	monitor := mon.NewTestSentinelMonitor("sentinel-scheduler-rate-test-stats")
+	clock := utils.NewFakeClock(testStart)
+	s := NewSentinelScheduler(db, monitor, broker, SentinelSchedulerConfig{MaxRate: 2})
+	s.SetClock(clock)
+
+	for i := 0; i < 5; i++ {
+		s.Publish("zdns", testInput(t, "a.valid.domain", testStart.Unix()))
+	}
+	if broker.Depth("zdns") != 2 || s.Backlog() != 3 {
+		t.Errorf("Expected 2 published and 3 held but got %d and %d", broker.Depth("zdns"), s.Backlog())
+	}
+
+	clock.Advance(time.Second)
+	if n := s.PublishDue(); n != 2 {
+		t.Errorf("Expected 2 published after a second but got %d", n)
+	}
+	clock.Advance(time.Second)
+	if n := s.PublishDue(); n != 1 || s.Backlog() != 0 {
+		t.Errorf("Expected the last message to be published but got %d", n)
+	}
+}
+
+func TestFractionalMaxRate(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	db := sentineldb.NewTestSentinelDB("sentinel-scheduler-fraction-test")
+	monitor := mon.NewTestSentinelMonitor("sentinel-scheduler-fraction-test-stats")
+	clock := utils.NewFakeClock(testStart)
+	s := NewSentinelScheduler(db, monitor, broker, SentinelSchedulerConfig{MaxRate: 0.5})
+	s.SetClock(clock)
+
+	for i := 0; i < 3; i++ {
+		s.Publish("zdns", testInput(t, "a.valid.domain", testStart.Unix()))
+	}
+	if broker.Depth("zdns") != 1 || s.Backlog() != 2 {
+		t.Errorf("Expected 1 published and 2 held but got %d and %d", broker.Depth("zdns"), s.Backlog())
+	}
+
+	// one message every two seconds
+	clock.Advance(time.Second)
+	if n := s.PublishDue(); n != 0 {
+		t.Errorf("Expected nothing published after a second but got %d", n)
+	}
+	clock.Advance(time.Second)
+	if n := s.PublishDue(); n != 1 {
+		t.Errorf("Expected 1 published after two seconds but got %d", n)
+	}
+	clock.Advance(10 * time.Second)
+	if n := s.PublishDue(); n != 1 || s.Backlog() != 0 {
+		t.Errorf("Expected the last message to be published but got %d", n)
+	}
+}
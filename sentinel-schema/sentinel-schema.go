@@ -0,0 +1,349 @@
+package sentinelschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SchemaVersion is stamped into the metadata of every message we publish.
+// zdns and zgrab echo the metadata back, so results carry the version of the
+// input that produced them. Messages without a version predate the schema.
+const SchemaVersion = 1
+
+// Message is implemented by every payload exchanged over the broker
+type Message interface {
+	Validate() error
+}
+
+// Marshal validates and encodes a message
+func Marshal(m Message) ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// Unmarshal decodes and validates a message
+func Unmarshal(data []byte, m Message) error {
+	if err := json.Unmarshal(data, m); err != nil {
+		return err
+	}
+	return m.Validate()
+}
+
+// Probe kinds of names derived from a wildcard certificate
+const (
+	// ProbeLabel is a common label, like www, under the wildcard
+	ProbeLabel = "label"
+	// ProbeRandom is a label that should not exist, used to detect DNS
+	// wildcarding of the zone
+	ProbeRandom = "random"
+)
+
+// Metadata travels with a domain through every zdns and zgrab stage
+type Metadata struct {
+	SchemaVersion int    `json:"schema_version"`
+	CertSHA1      string `json:"cert_sha1"`
+	CertSerial    string `json:"cert_serial,omitempty"`
+	// CertIssuer is the aggregated issuer, which scopes the serial
+	CertIssuer string `json:"cert_issuer,omitempty"`
+	ScanAfter  string `json:"scan_after"`
+	CertType   string `json:"cert_type"`
+	// Wildcard is set when the name comes from a *. entry of the certificate
+	Wildcard bool   `json:"wildcard,omitempty"`
+	Probe    string `json:"probe,omitempty"`
+	// Attempt counts the retries of a failed zdns lookup
+	Attempt int `json:"attempt,omitempty"`
+}
+
+// NewMetadata creates metadata for a certificate first seen at scanAfter
+func NewMetadata(certSHA1 string, certSerial string, certType string, scanAfter int64) Metadata {
+	return Metadata{
+		SchemaVersion: SchemaVersion,
+		CertSHA1:      certSHA1,
+		CertSerial:    certSerial,
+		ScanAfter:     strconv.FormatInt(scanAfter, 10),
+		CertType:      certType,
+	}
+}
+
+// ScanAfterUnix returns scan_after as seconds since the epoch
+func (m Metadata) ScanAfterUnix() int64 {
+	scanAfter, _ := strconv.ParseInt(m.ScanAfter, 0, 64)
+	return scanAfter
+}
+
+// Delayed returns a copy of the metadata scheduled delay seconds later
+func (m Metadata) Delayed(delay int64) Metadata {
+	m.SchemaVersion = SchemaVersion
+	m.ScanAfter = strconv.FormatInt(m.ScanAfterUnix()+delay, 10)
+	return m
+}
+
+// At returns a copy of the metadata scheduled at scanAfter
+func (m Metadata) At(scanAfter int64) Metadata {
+	m.SchemaVersion = SchemaVersion
+	m.ScanAfter = strconv.FormatInt(scanAfter, 10)
+	return m
+}
+
+func (m Metadata) Validate() error {
+	if m.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("unsupported schema version %d", m.SchemaVersion)
+	}
+	if m.ScanAfter != "" {
+		if _, err := strconv.ParseInt(m.ScanAfter, 0, 64); err != nil {
+			return fmt.Errorf("invalid scan_after %q", m.ScanAfter)
+		}
+	}
+	switch m.Probe {
+	case "", ProbeLabel, ProbeRandom:
+	default:
+		return fmt.Errorf("invalid probe %q", m.Probe)
+	}
+	return nil
+}
+
+func validateName(field string, name string) error {
+	if name == "" {
+		return fmt.Errorf("missing %s", field)
+	}
+	if strings.ContainsAny(name, " \t\r\n\"\\") {
+		return fmt.Errorf("invalid %s %q", field, name)
+	}
+	return nil
+}
+
+// ZDNSInput is published to the zdns worker topics
+type ZDNSInput struct {
+	Domain   string   `json:"domain"`
+	Metadata Metadata `json:"metadata"`
+}
+
+func (m *ZDNSInput) Validate() error {
+	if err := validateName("domain", m.Domain); err != nil {
+		return err
+	}
+	return m.Metadata.Validate()
+}
+
+// ZDNSRecord is a resource record of a zdns response
+type ZDNSRecord struct {
+	Type   string `json:"type"`
+	Class  string `json:"class,omitempty"`
+	Name   string `json:"name"`
+	TTL    uint32 `json:"ttl"`
+	Answer string `json:"answer"`
+}
+
+type ZDNSResultData struct {
+	BaseName      string   `json:"base_name"`
+	Name          string   `json:"name"`
+	IPv4Addresses []string `json:"ipv4_addresses"`
+	IPv6Addresses []string `json:"ipv6_addresses"`
+	// The records, resolver and protocol are sent by modules that return
+	// answers. alookup only returns the addresses, see ZDNSResult.Lookup.
+	Answers     []ZDNSRecord `json:"answers,omitempty"`
+	Authorities []ZDNSRecord `json:"authorities,omitempty"`
+	Additionals []ZDNSRecord `json:"additionals,omitempty"`
+	Resolver    string       `json:"resolver,omitempty"`
+	Protocol    string       `json:"protocol,omitempty"`
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// CNAMEChain follows the CNAME answers starting at the queried name and
+// returns the names it leads to, in order
+func (d ZDNSResultData) CNAMEChain() []string {
+	targets := make(map[string]string)
+	for _, record := range d.Answers {
+		if record.Type == "CNAME" {
+			targets[canonicalName(record.Name)] = canonicalName(record.Answer)
+		}
+	}
+	chain := []string{}
+	seen := map[string]bool{}
+	name := canonicalName(d.Name)
+	for {
+		target, ok := targets[name]
+		// stop on loops
+		if !ok || seen[target] {
+			return chain
+		}
+		seen[target] = true
+		chain = append(chain, target)
+		name = target
+	}
+}
+
+// NameServers returns the NS records of the authority section
+func (d ZDNSResultData) NameServers() []string {
+	nameServers := []string{}
+	for _, record := range d.Authorities {
+		if record.Type == "NS" {
+			nameServers = append(nameServers, canonicalName(record.Answer))
+		}
+	}
+	return nameServers
+}
+
+// ZDNSTraceStep is one of the lookups zdns made for a name, sent when it
+// runs with --trace
+type ZDNSTraceStep struct {
+	Results    ZDNSResultData `json:"results"`
+	Name       string         `json:"name"`
+	NameServer string         `json:"name_server"`
+	Layer      string         `json:"layer"`
+	Depth      int            `json:"depth"`
+}
+
+// ZDNSResult is the zdns alookup output read from the zdns result topics
+type ZDNSResult struct {
+	Data      ZDNSResultData  `json:"data"`
+	MetaData  Metadata        `json:"metadata"`
+	Status    string          `json:"status"`
+	Class     string          `json:"class,omitempty"`
+	Timestamp string          `json:"timestamp"`
+	Trace     []ZDNSTraceStep `json:"trace,omitempty"`
+}
+
+// Lookup returns the result data with the answers of the traced lookups.
+// alookup follows CNAMEs itself and only returns the addresses it ends at, so
+// the chain is only found in the trace. Data that carries answers is returned
+// as it is.
+func (m *ZDNSResult) Lookup() ZDNSResultData {
+	data := m.Data
+	if len(data.Answers) > 0 {
+		return data
+	}
+	seen := make(map[ZDNSRecord]bool)
+	for _, step := range m.Trace {
+		for _, record := range step.Results.Answers {
+			if !seen[record] {
+				seen[record] = true
+				data.Answers = append(data.Answers, record)
+			}
+		}
+		if data.Resolver == "" {
+			data.Resolver = step.Results.Resolver
+			data.Protocol = step.Results.Protocol
+		}
+	}
+	return data
+}
+
+func (m *ZDNSResult) Validate() error {
+	if err := validateName("name", m.Data.Name); err != nil {
+		return err
+	}
+	return m.MetaData.Validate()
+}
+
+// ZGrabInput is published to the zgrab worker topics
+type ZGrabInput struct {
+	SNI      string   `json:"sni"`
+	IP       string   `json:"ip"`
+	Metadata Metadata `json:"metadata"`
+}
+
+func (m *ZGrabInput) Validate() error {
+	if err := validateName("sni", m.SNI); err != nil {
+		return err
+	}
+	if net.ParseIP(m.IP) == nil {
+		return fmt.Errorf("invalid ip %q", m.IP)
+	}
+	return m.Metadata.Validate()
+}
+
+type ZGrabCertificate struct {
+	Raw    []byte `json:"raw"`
+	Parsed struct {
+		FingerprintSHA1 string `json:"fingerprint_sha1"`
+	} `json:"parsed"`
+}
+
+type ZGrabTLSResult struct {
+	Status    string `json:"status"`
+	Protocol  string `json:"protocol"`
+	Timestamp string `json:"timestamp"`
+	Error     string `json:"error"`
+	Result    struct {
+		HandshakeLog struct {
+			ServerCertificates struct {
+				Certificate ZGrabCertificate   `json:"certificate"`
+				Chain       []ZGrabCertificate `json:"chain"`
+			} `json:"server_certificates"`
+		} `json:"handshake_log"`
+	} `json:"result"`
+}
+
+type ZGrabResultData struct {
+	TLS ZGrabTLSResult `json:"tls"`
+}
+
+// ZGrabResult is the zgrab2 output read from the zgrab result topics
+type ZGrabResult struct {
+	IP       string          `json:"ip"`
+	Domain   string          `json:"domain"`
+	Data     ZGrabResultData `json:"data"`
+	MetaData Metadata        `json:"metadata"`
+}
+
+func (m *ZGrabResult) Validate() error {
+	// results are stored under zgrab|<domain>|<ip>
+	if err := validateName("domain", m.Domain); err != nil {
+		return err
+	}
+	if m.IP == "" {
+		return fmt.Errorf("missing ip")
+	}
+	return m.MetaData.Validate()
+}
+
+type CertstreamCert struct {
+	AllDomains   []string          `json:"all_domains"`
+	Fingerprint  string            `json:"fingerprint"`
+	SerialNumber string            `json:"serial_number"`
+	NotBefore    float64           `json:"not_before"`
+	NotAfter     float64           `json:"not_after"`
+	Subject      map[string]string `json:"subject"`
+	Issuer       map[string]string `json:"issuer"`
+	// SignatureAlgorithm is only sent by certstream-server-go
+	SignatureAlgorithm string `json:"signature_algorithm,omitempty"`
+	// AsDER is the base64 encoded certificate, sent when the full stream is used
+	AsDER string `json:"as_der,omitempty"`
+}
+
+type CertstreamSource struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type CertstreamData struct {
+	UpdateType string           `json:"update_type"`
+	LeafCert   CertstreamCert   `json:"leaf_cert"`
+	Chain      []CertstreamCert `json:"chain"`
+	CertIndex  int64            `json:"cert_index"`
+	CertLink   string           `json:"cert_link"`
+	Seen       float64          `json:"seen"`
+	Source     CertstreamSource `json:"source"`
+}
+
+// CertstreamEvent is a single message of the certstream websocket feed
+type CertstreamEvent struct {
+	MessageType string         `json:"message_type"`
+	Data        CertstreamData `json:"data"`
+}
+
+func (m *CertstreamEvent) Validate() error {
+	if m.MessageType == "" {
+		return fmt.Errorf("missing message_type")
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package sentinelschema
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	input := ZDNSInput{
+		Domain:   "www.valid.domain",
+		Metadata: NewMetadata("abcdef", "1092", "PrecertLogEntry", 1677664800),
+	}
+	data, err := Marshal(&input)
+	if err != nil {
+		t.Fatalf("Unable to marshal: %s", err)
+	}
+	var decoded ZDNSInput
+	if err := Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unable to unmarshal %s: %s", data, err)
+	}
+	if decoded != input {
+		t.Errorf("Expected %+v but got %+v", input, decoded)
+	}
+	if decoded.Metadata.SchemaVersion != SchemaVersion {
+		t.Errorf("Expected schema version %d but got %d", SchemaVersion, decoded.Metadata.SchemaVersion)
+	}
+}
+
+func TestDelayed(t *testing.T) {
+	metadata := NewMetadata("abcdef", "", "PrecertLogEntry", 1000)
+	delayed := metadata.Delayed(3600)
+	if delayed.ScanAfter != "4600" {
+		t.Errorf("Expected scan_after 4600 but got %s", delayed.ScanAfter)
+	}
+	if metadata.ScanAfter != "1000" {
+		t.Errorf("Expected original scan_after to be unchanged but got %s", metadata.ScanAfter)
+	}
+}
+
+func TestLegacyMessage(t *testing.T) {
+	// messages published before the schema carry no version
+	body := []byte(`{"data": {"name": "www.valid.domain", "ipv4_addresses": ["192.0.2.1"]}, "metadata": {"cert_sha1": "abcdef", "scan_after": "1000", "cert_type": "PrecertLogEntry"}, "status": "NOERROR"}`)
+	var result ZDNSResult
+	if err := Unmarshal(body, &result); err != nil {
+		t.Errorf("Expected legacy message to be accepted but got %s", err)
+	}
+}
+
+func TestInvalidMessages(t *testing.T) {
+	invalid := []Message{
+		&ZDNSInput{Domain: `www.valid.domain", "x": "`},
+		&ZDNSInput{Domain: ""},
+		&ZDNSInput{Domain: "www.valid.domain", Metadata: Metadata{ScanAfter: "soon"}},
+		&ZDNSInput{Domain: "www.valid.domain", Metadata: Metadata{SchemaVersion: SchemaVersion + 1}},
+		&ZDNSInput{Domain: "www.valid.domain", Metadata: Metadata{Probe: "sometimes"}},
+		&ZGrabInput{SNI: "www.valid.domain", IP: "not-an-ip"},
+		&ZDNSResult{},
+		&ZGrabResult{},
+		&ZGrabResult{IP: "192.0.2.1"},
+		&ZGrabResult{Domain: "www.valid.domain"},
+		&CertstreamEvent{},
+	}
+	for idx, m := range invalid {
+		if _, err := Marshal(m); err == nil {
+			t.Errorf("Expected message %d to be rejected", idx)
+		}
+	}
+}
+
+func TestLongZDNSResult(t *testing.T) {
+	body := []byte(`{"name": "www.valid.domain", "class": "IN", "status": "NOERROR", "timestamp": "2023-03-01T10:00:00Z",
+		"data": {"name": "www.valid.domain", "ipv4_addresses": ["192.0.2.1"], "resolver": "8.8.8.8:53", "protocol": "udp",
+			"answers": [
+				{"type": "A", "class": "IN", "name": "edge.cdn.domain", "ttl": 20, "answer": "192.0.2.1"},
+				{"type": "CNAME", "class": "IN", "name": "www.valid.domain", "ttl": 300, "answer": "valid.cdn.domain."},
+				{"type": "CNAME", "class": "IN", "name": "valid.cdn.domain", "ttl": 60, "answer": "edge.cdn.domain."}
+			],
+			"authorities": [{"type": "NS", "class": "IN", "name": "cdn.domain", "ttl": 3600, "answer": "NS1.cdn.domain."}]},
+		"metadata": {"schema_version": 1, "cert_sha1": "abcdef", "scan_after": "1000", "cert_type": "PrecertLogEntry"}}`)
+	var result ZDNSResult
+	if err := Unmarshal(body, &result); err != nil {
+		t.Fatalf("Unable to parse %s", err)
+	}
+	chain := result.Data.CNAMEChain()
+	if len(chain) != 2 || chain[0] != "valid.cdn.domain" || chain[1] != "edge.cdn.domain" {
+		t.Errorf("Unexpected CNAME chain %v", chain)
+	}
+	nameServers := result.Data.NameServers()
+	if len(nameServers) != 1 || nameServers[0] != "ns1.cdn.domain" {
+		t.Errorf("Unexpected name servers %v", nameServers)
+	}
+	if result.Data.Answers[1].TTL != 300 || result.Data.Resolver != "8.8.8.8:53" {
+		t.Errorf("Unexpected records %+v", result.Data)
+	}
+
+	// a CNAME loop ends the chain
+	loop := ZDNSResultData{Name: "a.valid.domain", Answers: []ZDNSRecord{
+		{Type: "CNAME", Name: "a.valid.domain", Answer: "b.valid.domain"},
+		{Type: "CNAME", Name: "b.valid.domain", Answer: "a.valid.domain"},
+	}}
+	if chain := loop.CNAMEChain(); len(chain) != 2 {
+		t.Errorf("Unexpected CNAME chain for a loop %v", chain)
+	}
+}
+
+// alookup returns the addresses in data and the CNAMEs it followed in the trace
+func TestTracedZDNSResult(t *testing.T) {
+	body, err := os.ReadFile("testdata/alookup-trace.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result ZDNSResult
+	if err := Unmarshal(bytes.TrimSpace(body), &result); err != nil {
+		t.Fatalf("Unable to parse %s", err)
+	}
+	if chain := result.Data.CNAMEChain(); len(chain) != 0 {
+		t.Errorf("Expected no answers in the alookup data but got %v", chain)
+	}
+	lookup := result.Lookup()
+	chain := lookup.CNAMEChain()
+	if len(chain) != 2 || chain[0] != "valid.cdn.domain" || chain[1] != "edge.cdn.domain" {
+		t.Errorf("Unexpected CNAME chain %v", chain)
+	}
+	// the CNAMEs of the A and AAAA lookups are only kept once
+	if len(lookup.Answers) != 3 || lookup.Resolver != "8.8.8.8:53" || lookup.Protocol != "udp" {
+		t.Errorf("Unexpected lookup %+v", lookup)
+	}
+	if len(lookup.IPv4Addresses) != 1 || lookup.Name != "www.valid.domain" {
+		t.Errorf("Expected the addresses of the data but got %+v", lookup)
+	}
+}
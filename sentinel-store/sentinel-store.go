@@ -14,6 +14,10 @@ type SentinelStore struct {
 }
 
 func (store *SentinelStore) Close() error {
+	// counters are merged without syncing, make sure they reach disk
+	if err := store.DB.Flush(); err != nil {
+		return err
+	}
 	return store.DB.Close()
 }
 
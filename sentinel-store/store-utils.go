@@ -4,6 +4,7 @@ import (
 	"io"
 	"strconv"
 
+	"github.com/cockroachdb/pebble"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -36,3 +37,24 @@ func (c *CounterValueMerger) MergeOlder(value []byte) error {
 func (c *CounterValueMerger) Finish(includesBase bool) ([]byte, io.Closer, error) {
 	return []byte(strconv.Itoa(c.Count)), nil, nil
 }
+
+// keyUpperBound returns the first key after every key starting with b
+func keyUpperBound(b []byte) []byte {
+	end := make([]byte, len(b))
+	copy(end, b)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i] = end[i] + 1
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil // no upper-bound
+}
+
+// PrefixIterOptions bounds an iterator to the keys starting with keyPrefix
+func PrefixIterOptions(keyPrefix []byte) *pebble.IterOptions {
+	return &pebble.IterOptions{
+		LowerBound: keyPrefix,
+		UpperBound: keyUpperBound(keyPrefix),
+	}
+}
@@ -0,0 +1,101 @@
+package sentinelsupervisor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type stage struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+type closer struct {
+	name  string
+	close func() error
+}
+
+// SentinelSupervisor runs the pipeline stages under one context. When the
+// context is cancelled, or any stage fails, every stage is asked to stop and
+// once all of them returned the closers run in the order they were added.
+type SentinelSupervisor struct {
+	stages  []stage
+	closers []closer
+}
+
+// SupervisorError reports every stage or closer that failed
+type SupervisorError struct {
+	Errors map[string]error
+}
+
+func (e *SupervisorError) Error() string {
+	names := []string{}
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := []string{}
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, e.Errors[name]))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func NewSentinelSupervisor() *SentinelSupervisor {
+	return &SentinelSupervisor{}
+}
+
+// Add registers a stage. run must return once ctx is done.
+func (s *SentinelSupervisor) Add(name string, run func(ctx context.Context) error) {
+	s.stages = append(s.stages, stage{name: name, run: run})
+}
+
+// AddCloser registers a resource to release after all stages returned
+func (s *SentinelSupervisor) AddCloser(name string, close func() error) {
+	s.closers = append(s.closers, closer{name: name, close: close})
+}
+
+// Run blocks until all stages returned and the closers ran
+func (s *SentinelSupervisor) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	errs := make(map[string]error)
+	var wg sync.WaitGroup
+	for _, st := range s.stages {
+		wg.Add(1)
+		go func(st stage) {
+			defer wg.Done()
+			err := st.run(ctx)
+			if err != nil {
+				log.Error(fmt.Sprintf("Supervisor: stage %s failed: %v", st.name, err))
+				mu.Lock()
+				errs[st.name] = err
+				mu.Unlock()
+			} else {
+				log.Info(fmt.Sprintf("Supervisor: stage %s stopped", st.name))
+			}
+			// a stage leaving takes the pipeline down with it
+			cancel()
+		}(st)
+	}
+	wg.Wait()
+
+	for _, c := range s.closers {
+		if err := c.close(); err != nil {
+			log.Error(fmt.Sprintf("Supervisor: closing %s failed: %v", c.name, err))
+			errs[c.name] = err
+		}
+	}
+
+	if len(errs) > 0 {
+		return &SupervisorError{Errors: errs}
+	}
+	return nil
+}
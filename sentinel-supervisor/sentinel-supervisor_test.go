@@ -0,0 +1,54 @@
+package sentinelsupervisor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestCancelStopsStages(t *testing.T) {
+	s := NewSentinelSupervisor()
+	order := []string{}
+	for _, name := range []string{"zdns", "zgrab"} {
+		s.Add(name, func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		})
+	}
+	s.AddCloser("broker", func() error {
+		order = append(order, "broker")
+		return nil
+	})
+	s.AddCloser("datastore", func() error {
+		order = append(order, "datastore")
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Run(ctx); err != nil {
+		t.Errorf("Expected clean shutdown but got %s", err)
+	}
+	if len(order) != 2 || order[0] != "broker" || order[1] != "datastore" {
+		t.Errorf("Expected closers to run in order but got %v", order)
+	}
+}
+
+func TestFailingStageStopsOthers(t *testing.T) {
+	s := NewSentinelSupervisor()
+	s.Add("certstream", func(ctx context.Context) error {
+		return fmt.Errorf("connection lost")
+	})
+	s.Add("zdns", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	err := s.Run(context.Background())
+	serr, ok := err.(*SupervisorError)
+	if !ok {
+		t.Fatalf("Expected a SupervisorError but got %v", err)
+	}
+	if len(serr.Errors) != 1 || serr.Errors["certstream"] == nil {
+		t.Errorf("Expected only certstream to fail but got %s", serr)
+	}
+}
@@ -0,0 +1,70 @@
+package sentineltestutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// R3 is the issuer the test certstream events name
+var R3 = pkix.Name{Country: []string{"US"}, Organization: []string{"Let's Encrypt"}, CommonName: "R3"}
+
+// TestCert describes a certificate to create for a test
+type TestCert struct {
+	Serial int64
+	// Domains are the SANs, the first one is also the subject common name
+	Domains []string
+	// Issuer signs the certificate, which is self-signed when it is empty
+	Issuer pkix.Name
+	// NotBefore defaults to 2023-03-01 09:00 UTC, NotAfter to 90 days later
+	NotBefore time.Time
+	NotAfter  time.Time
+	// Precert adds the CT poison extension
+	Precert bool
+}
+
+// Certificate returns the DER of an ECDSA P-256 certificate described by c
+func Certificate(t testing.TB, c TestCert) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(c.Serial),
+		NotBefore:    c.NotBefore,
+		NotAfter:     c.NotAfter,
+	}
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Unix(1677661200, 0)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = template.NotBefore.Add(90 * 24 * time.Hour)
+	}
+	if len(c.Domains) > 0 {
+		template.Subject = pkix.Name{CommonName: c.Domains[0]}
+		template.DNSNames = c.Domains
+	}
+	if c.Precert {
+		template.ExtraExtensions = []pkix.Extension{{
+			Id:       asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3},
+			Critical: true,
+			Value:    []byte{0x05, 0x00},
+		}}
+	}
+	parent := template
+	if c.Issuer.String() != "" {
+		parent = &x509.Certificate{Subject: c.Issuer}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
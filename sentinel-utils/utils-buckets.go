@@ -0,0 +1,204 @@
+package sentinelutils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	log "github.com/sirupsen/logrus"
+)
+
+// Every increment is also added to a bucket per resolution, stored under
+// bucket|<resolution>|<start>|<key> so that a time range of all counters is a
+// single scan and expired buckets are a single range deletion.
+const (
+	bucketPrefix = "bucket|"
+	bucketsEnd   = "bucket}"
+)
+
+// Resolutions of the bucketed counters
+var Resolutions = map[string]time.Duration{
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+// SentinelCountersRetention is how long the buckets of each resolution are
+// kept. Zero keeps the default.
+type SentinelCountersRetention struct {
+	Minute time.Duration `yaml:"minute"`
+	Hour   time.Duration `yaml:"hour"`
+	Day    time.Duration `yaml:"day"`
+}
+
+func (r SentinelCountersRetention) withDefaults() SentinelCountersRetention {
+	if r.Minute <= 0 {
+		r.Minute = 24 * time.Hour
+	}
+	if r.Hour <= 0 {
+		r.Hour = 31 * 24 * time.Hour
+	}
+	if r.Day <= 0 {
+		r.Day = 366 * 24 * time.Hour
+	}
+	return r
+}
+
+func (r SentinelCountersRetention) of(resolution string) time.Duration {
+	switch resolution {
+	case "minute":
+		return r.Minute
+	case "hour":
+		return r.Hour
+	default:
+		return r.Day
+	}
+}
+
+// Bucket is the count of a counter in the bucket starting at Start
+type Bucket struct {
+	Start int64 `json:"start"`
+	Count int   `json:"count"`
+}
+
+func bucketKey(resolution string, start int64, key string) []byte {
+	return []byte(fmt.Sprintf("%s%s|%020d|%s", bucketPrefix, resolution, start, key))
+}
+
+// SetClock replaces the clock deciding which bucket an increment goes to
+func (ctrdb *SentinelCounters) SetClock(clock Clock) {
+	ctrdb.clock = clock
+}
+
+// SetRetention replaces how long buckets are kept
+func (ctrdb *SentinelCounters) SetRetention(retention SentinelCountersRetention) {
+	ctrdb.retention = retention.withDefaults()
+}
+
+func (ctrdb *SentinelCounters) now() time.Time {
+	if ctrdb.clock == nil {
+		return time.Now()
+	}
+	return ctrdb.clock.Now()
+}
+
+// addToBuckets merges the increment into the current bucket of every resolution
+func (ctrdb *SentinelCounters) addToBuckets(key string, value []byte) {
+	now := ctrdb.now().Unix()
+	for resolution, width := range Resolutions {
+		seconds := int64(width.Seconds())
+		ctrdb.store.DB.Merge(bucketKey(resolution, now-now%seconds, key), value, pebble.NoSync)
+	}
+}
+
+// FetchBuckets returns the buckets of the counters starting with keyPrefix
+// that overlap [from, to), oldest first
+func (ctrdb *SentinelCounters) FetchBuckets(keyPrefix []byte, resolution string, from int64, to int64) (map[string][]Bucket, error) {
+	width, ok := Resolutions[resolution]
+	if !ok {
+		return nil, fmt.Errorf("unknown resolution %s", resolution)
+	}
+	seconds := int64(width.Seconds())
+	from -= from % seconds
+
+	data := make(map[string][]Bucket)
+	iter := ctrdb.FetchAllKeysIterator([]byte(bucketPrefix + resolution + "|"))
+	defer iter.Close()
+	for iter.SeekGE(bucketKey(resolution, from, "")); iter.Valid(); iter.Next() {
+		fields := strings.SplitN(strings.TrimPrefix(string(iter.Key()), bucketPrefix+resolution+"|"), "|", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		start, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if start >= to {
+			break
+		}
+		if !strings.HasPrefix(fields[1], string(keyPrefix)) {
+			continue
+		}
+		count, _ := strconv.Atoi(string(iter.Value()))
+		data[fields[1]] = append(data[fields[1]], Bucket{Start: start, Count: count})
+	}
+	return data, nil
+}
+
+// Prune deletes the buckets that are past their retention
+func (ctrdb *SentinelCounters) Prune() error {
+	now := ctrdb.now()
+	for resolution := range Resolutions {
+		cutoff := now.Add(-ctrdb.retention.of(resolution)).Unix()
+		start := bucketKey(resolution, 0, "")
+		end := bucketKey(resolution, cutoff, "")
+		if err := ctrdb.store.DB.DeleteRange(start, end, pebble.NoSync); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run prunes expired buckets every minute until ctx is done
+func (ctrdb *SentinelCounters) Run(ctx context.Context) error {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		if err := ctrdb.Prune(); err != nil {
+			log.Error(err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// RenameKeys moves the total and the buckets of every counter for which
+// rename returns a new key, adding them to what the new key already holds.
+// It returns the number of counters moved.
+func (ctrdb *SentinelCounters) RenameKeys(rename func(key string) (string, bool)) (int, error) {
+	batch := ctrdb.store.DB.NewBatch()
+	defer batch.Close()
+	renamed := 0
+	iter := ctrdb.FetchAllKeysIterator(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		var newKey string
+		if strings.HasPrefix(key, bucketPrefix) {
+			// bucket|<resolution>|<start>|<key>
+			fields := strings.SplitN(key, "|", 4)
+			if len(fields) != 4 {
+				continue
+			}
+			renamedKey, ok := rename(fields[3])
+			if !ok {
+				continue
+			}
+			newKey = strings.Join(append(fields[:3], renamedKey), "|")
+		} else {
+			renamedKey, ok := rename(key)
+			if !ok {
+				continue
+			}
+			newKey = renamedKey
+			renamed++
+		}
+		if err := batch.Merge([]byte(newKey), iter.Value(), nil); err != nil {
+			iter.Close()
+			return 0, err
+		}
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			iter.Close()
+			return 0, err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+	return renamed, batch.Commit(pebble.Sync)
+}
@@ -0,0 +1,57 @@
+package sentinelutils
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"strings"
+)
+
+// FormatSHA1 removes the colons from a fingerprint and lower cases it
+func FormatSHA1(s string) string {
+	s = strings.ReplaceAll(s, ":", "")
+	return strings.ToLower(s)
+}
+
+// emailAddress is not one of the parsed pkix.Name fields
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// NameFields describes a name the way certstream does. aggregated lists the
+// fields in /C=../ST=../L=../O=../OU=../CN=.. order rather than RFC 2253 so
+// that names match between certstream and certificates parsed here.
+func NameFields(name pkix.Name) map[string]string {
+	first := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+	email := ""
+	for _, attr := range name.Names {
+		if value, ok := attr.Value.(string); ok && attr.Type.Equal(oidEmailAddress) {
+			email = value
+			break
+		}
+	}
+	fields := map[string]string{}
+	aggregated := ""
+	for _, field := range []struct {
+		key   string
+		value string
+	}{
+		{"C", first(name.Country)},
+		{"ST", first(name.Province)},
+		{"L", first(name.Locality)},
+		{"O", first(name.Organization)},
+		{"OU", first(name.OrganizationalUnit)},
+		{"CN", name.CommonName},
+		{"emailAddress", email},
+	} {
+		if field.value == "" {
+			continue
+		}
+		fields[field.key] = field.value
+		aggregated += "/" + field.key + "=" + field.value
+	}
+	fields["aggregated"] = aggregated
+	return fields
+}
@@ -1,6 +1,7 @@
 package sentinelutils
 
 import (
+	"bytes"
 	"strconv"
 
 	"github.com/cockroachdb/pebble"
@@ -9,7 +10,9 @@ import (
 )
 
 type SentinelCounters struct {
-	store *sentinelstore.SentinelStore
+	store     *sentinelstore.SentinelStore
+	clock     Clock
+	retention SentinelCountersRetention
 }
 
 func NewTestSentinelCounter(storeName string) *SentinelCounters {
@@ -18,15 +21,37 @@ func NewTestSentinelCounter(storeName string) *SentinelCounters {
 
 func NewSentinelCounter(storeName string, tmpDB bool) *SentinelCounters {
 	return &SentinelCounters{
-		store: sentinelstore.NewSentinelCounterStore(storeName, tmpDB),
+		store:     sentinelstore.NewSentinelCounterStore(storeName, tmpDB),
+		retention: SentinelCountersRetention{}.withDefaults(),
 	}
 }
 
+// Close flushes and releases the counter store
+func (ctrdb *SentinelCounters) Close() error {
+	return ctrdb.store.Close()
+}
+
 func (ctrdb *SentinelCounters) Incr(key string) error {
 	ctrdb.store.DB.Merge([]byte(key), []byte("1"), pebble.NoSync)
+	ctrdb.addToBuckets(key, []byte("1"))
+	return nil
+}
+
+// IncrBy adds n to the counter
+func (ctrdb *SentinelCounters) IncrBy(key string, n int64) error {
+	value := []byte(strconv.FormatInt(n, 10))
+	ctrdb.store.DB.Merge([]byte(key), value, pebble.NoSync)
+	ctrdb.addToBuckets(key, value)
 	return nil
 }
 
+// HasPrefix reports whether any counter starts with keyPrefix
+func (ctrdb *SentinelCounters) HasPrefix(keyPrefix []byte) bool {
+	iter := ctrdb.FetchAllKeysIterator(keyPrefix)
+	defer iter.Close()
+	return iter.First()
+}
+
 func (ctrdb *SentinelCounters) Get(key string) (int, error) {
 	value, ioc, err := ctrdb.store.DB.Get([]byte(key))
 	if err != nil {
@@ -38,10 +63,18 @@ func (ctrdb *SentinelCounters) Get(key string) (int, error) {
 	return val, err
 }
 
+// FetchData returns the totals of the counters starting with keyPrefix
 func (ctrdb *SentinelCounters) FetchData(keyPrefix []byte) map[string]int {
 	data := make(map[string]int)
 	iter := ctrdb.FetchAllKeysIterator(keyPrefix)
-	for iter.First(); iter.Valid(); iter.Next() {
+	defer iter.Close()
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if bytes.HasPrefix(iter.Key(), []byte(bucketPrefix)) {
+			// skip over the buckets, which sort together
+			if !iter.SeekGE([]byte(bucketsEnd)) {
+				break
+			}
+		}
 		k := string(iter.Key())
 		val, _ := strconv.Atoi(string(iter.Value()))
 		data[k] = val
@@ -50,23 +83,5 @@ func (ctrdb *SentinelCounters) FetchData(keyPrefix []byte) map[string]int {
 }
 
 func (ctrdb *SentinelCounters) FetchAllKeysIterator(keyPrefix []byte) *pebble.Iterator {
-	keyUpperBound := func(b []byte) []byte {
-		end := make([]byte, len(b))
-		copy(end, b)
-		for i := len(end) - 1; i >= 0; i-- {
-			end[i] = end[i] + 1
-			if end[i] != 0 {
-				return end[:i+1]
-			}
-		}
-		return nil // no upper-bound
-	}
-
-	prefixIterOptions := func(keyPrefix []byte) *pebble.IterOptions {
-		return &pebble.IterOptions{
-			LowerBound: keyPrefix,
-			UpperBound: keyUpperBound(keyPrefix),
-		}
-	}
-	return ctrdb.store.DB.NewIter(prefixIterOptions(keyPrefix))
+	return ctrdb.store.DB.NewIter(sentinelstore.PrefixIterOptions(keyPrefix))
 }
@@ -1,7 +1,9 @@
 package sentinelutils
 
 import (
+	"reflect"
 	"testing"
+	"time"
 )
 
 func InitTest(t *testing.T) *SentinelCounters {
@@ -60,3 +62,50 @@ func TestPrefixData(t *testing.T) {
 		t.Errorf("Expected length as 2 but got %d\n", len(data))
 	}
 }
+
+func TestBuckets(t *testing.T) {
+	counters := InitTest(t)
+	clock := NewFakeClock(time.Unix(1677664800, 0))
+	counters.SetClock(clock)
+	counters.SetRetention(SentinelCountersRetention{Minute: time.Hour})
+
+	counters.Incr("cat1.test")
+	counters.IncrBy("cat1.test", 2)
+	clock.Advance(90 * time.Second)
+	counters.Incr("cat1.test")
+	counters.Incr("cat2.test")
+
+	if data := counters.FetchData(nil); len(data) != 2 || data["cat1.test"] != 4 {
+		t.Errorf("Expected only the totals but got %v", data)
+	}
+	buckets, err := counters.FetchBuckets([]byte("cat1"), "minute", 1677664800, 1677664800+3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Bucket{{Start: 1677664800, Count: 3}, {Start: 1677664860, Count: 1}}
+	if len(buckets) != 1 || !reflect.DeepEqual(buckets["cat1.test"], expected) {
+		t.Errorf("Expected %v but got %v", expected, buckets)
+	}
+	buckets, _ = counters.FetchBuckets(nil, "hour", 1677664800, 1677664801)
+	if buckets["cat1.test"][0].Count != 4 || buckets["cat2.test"][0].Count != 1 {
+		t.Errorf("Expected the hour to hold every increment but got %v", buckets)
+	}
+	if _, err := counters.FetchBuckets(nil, "week", 0, 1); err == nil {
+		t.Errorf("Expected an unknown resolution to be rejected")
+	}
+
+	// minute buckets expire after an hour, hour buckets are kept
+	clock.Advance(2 * time.Hour)
+	if err := counters.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if buckets, _ := counters.FetchBuckets(nil, "minute", 0, 1677664800+3600); len(buckets) != 0 {
+		t.Errorf("Expected minute buckets to be pruned but got %v", buckets)
+	}
+	if buckets, _ := counters.FetchBuckets(nil, "hour", 0, 1677664800+3600); len(buckets) != 2 {
+		t.Errorf("Expected hour buckets to be kept but got %v", buckets)
+	}
+	if val, _ := counters.Get("cat1.test"); val != 4 {
+		t.Errorf("Expected the total to survive pruning but got %d", val)
+	}
+}
@@ -0,0 +1,198 @@
+package zdnsorc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+)
+
+// Outcomes of comparing a zdns result with the previous one for the name
+const (
+	ChangeNew         = "new"
+	ChangeStable      = "stable"
+	ChangeChanged     = "changed"
+	ChangeDisappeared = "disappeared"
+)
+
+// SentinelDBObservation is the latest result for a name, stored under
+// zdns|last|<name>
+type SentinelDBObservation struct {
+	Stage         string   `json:"stage"`
+	IPv4Addresses []string `json:"ipv4"`
+	IPv6Addresses []string `json:"ipv6"`
+	Timestamp     string   `json:"timestamp"`
+}
+
+// SentinelDBChange is appended to zdns|changes|<name> and indexed by time
+// under zdns|changelog|<unix>|<sequence>|<name> whenever the addresses of a name change
+type SentinelDBChange struct {
+	Name              string   `json:"name"`
+	Outcome           string   `json:"outcome"`
+	Stage             string   `json:"stage"`
+	PreviousStage     string   `json:"previous_stage"`
+	PreviousTimestamp string   `json:"previous_timestamp"`
+	Timestamp         string   `json:"timestamp"`
+	AddedIPv4         []string `json:"added_ipv4"`
+	RemovedIPv4       []string `json:"removed_ipv4"`
+	AddedIPv6         []string `json:"added_ipv6"`
+	RemovedIPv6       []string `json:"removed_ipv6"`
+}
+
+// diffAddresses returns the addresses only in current and only in previous
+func diffAddresses(previous []string, current []string) ([]string, []string) {
+	seen := make(map[string]bool)
+	for _, ip := range previous {
+		seen[ip] = true
+	}
+	added := []string{}
+	for _, ip := range current {
+		if !seen[ip] {
+			added = append(added, ip)
+		}
+		delete(seen, ip)
+	}
+	removed := []string{}
+	for _, ip := range previous {
+		if seen[ip] {
+			removed = append(removed, ip)
+			delete(seen, ip)
+		}
+	}
+	return added, removed
+}
+
+// changelogSeq keeps the changelog keys of changes within a second apart,
+// it is shared by the stages as they all write to the changelog
+var changelogSeq = uint64(time.Now().UnixNano())
+
+func changelogKey(ts int64, seq uint64, name string) string {
+	return fmt.Sprintf("zdns|changelog|%020d|%020d|%s", ts, seq, name)
+}
+
+// detectChange compares the result with the previous observation of the name,
+// records the change if there is one and returns the outcome
+func (szo *SentinelZDNSOrchestrator) detectChange(result schema.ZDNSResult) (string, error) {
+	name := result.Data.Name
+	current := SentinelDBObservation{
+		Stage:         szo.stageName,
+		IPv4Addresses: result.Data.IPv4Addresses,
+		IPv6Addresses: result.Data.IPv6Addresses,
+		Timestamp:     result.Timestamp,
+	}
+	value, err := json.Marshal(current)
+	if err != nil {
+		return "", err
+	}
+
+	lastKey := fmt.Sprintf("zdns|last|%s", name)
+	last, _ := szo.db.Get(lastKey)
+	if err := szo.db.Set(lastKey, value); err != nil {
+		return "", err
+	}
+
+	outcome := ChangeNew
+	change := SentinelDBChange{
+		Name:      name,
+		Stage:     szo.stageName,
+		Timestamp: result.Timestamp,
+	}
+	if len(last) > 0 {
+		var previous SentinelDBObservation
+		if err := json.Unmarshal(last, &previous); err != nil {
+			return "", err
+		}
+		change.PreviousStage = previous.Stage
+		change.PreviousTimestamp = previous.Timestamp
+		change.AddedIPv4, change.RemovedIPv4 = diffAddresses(previous.IPv4Addresses, current.IPv4Addresses)
+		change.AddedIPv6, change.RemovedIPv6 = diffAddresses(previous.IPv6Addresses, current.IPv6Addresses)
+
+		switch {
+		case len(current.IPv4Addresses)+len(current.IPv6Addresses) == 0 && len(previous.IPv4Addresses)+len(previous.IPv6Addresses) > 0:
+			outcome = ChangeDisappeared
+		case len(change.AddedIPv4)+len(change.RemovedIPv4)+len(change.AddedIPv6)+len(change.RemovedIPv6) > 0:
+			outcome = ChangeChanged
+		default:
+			outcome = ChangeStable
+		}
+	}
+	szo.monitor.Incr(mon.ZDNSChanges, szo.stageName, outcome)
+	if outcome != ChangeChanged && outcome != ChangeDisappeared {
+		return outcome, nil
+	}
+
+	change.Outcome = outcome
+	value, err = json.Marshal(change)
+	if err != nil {
+		return outcome, err
+	}
+	if err := szo.db.AddResult(fmt.Sprintf("zdns|changes|%s", name), value); err != nil {
+		return outcome, err
+	}
+	return outcome, szo.db.Set(changelogKey(szo.clock.Now().Unix(), atomic.AddUint64(&changelogSeq, 1), name), value)
+}
+
+// Changes returns the changes of a name, oldest first
+func Changes(db *sentineldb.SentinelDB, name string) []SentinelDBChange {
+	changes := []SentinelDBChange{}
+	value, _ := db.Get(fmt.Sprintf("zdns|changes|%s", name))
+	for _, line := range bytes.Split(value, []byte("\n")) {
+		var change SentinelDBChange
+		if json.Unmarshal(line, &change) == nil {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// ChangesSince returns up to limit changes recorded at or after since,
+// oldest first
+func ChangesSince(db *sentineldb.SentinelDB, since int64, limit int) []SentinelDBChange {
+	changes := []SentinelDBChange{}
+	iter := db.FetchAllKeysIterator([]byte("zdns|changelog|"))
+	defer iter.Close()
+	for iter.SeekGE([]byte(changelogKey(since, 0, ""))); iter.Valid() && len(changes) < limit; iter.Next() {
+		var change SentinelDBChange
+		if json.Unmarshal(iter.Value(), &change) == nil {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// ChangesHandler serves /changes?domain=<name> or /changes?since=<unix>&limit=<n>
+func ChangesHandler(db *sentineldb.SentinelDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var changes []SentinelDBChange
+		if name := query.Get("domain"); name != "" {
+			changes = Changes(db, name)
+		} else {
+			since, err := strconv.ParseInt(query.Get("since"), 10, 64)
+			if err != nil {
+				http.Error(w, "domain or since is required", http.StatusBadRequest)
+				return
+			}
+			limit := 1000
+			if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 {
+				limit = l
+			}
+			changes = ChangesSince(db, since, limit)
+		}
+		jsonData, err := json.Marshal(changes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonData)
+	}
+}
@@ -0,0 +1,108 @@
+package zdnsorc
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+)
+
+func testResult(ipv4 ...string) schema.ZDNSResult {
+	return schema.ZDNSResult{
+		Data:   schema.ZDNSResultData{Name: "a.valid.domain", IPv4Addresses: ipv4},
+		Status: "NOERROR",
+	}
+}
+
+func TestDetectChange(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	db := sentineldb.NewTestSentinelDB("zdns-changes-test")
+	monitor := mon.NewTestSentinelMonitor("zdns-changes-test-stats")
+	clock := utils.NewFakeClock(time.Unix(1677664800, 0))
+	first := NewSentinelZDNSStageOrchestrator(db, monitor, broker, true, false, "zgrab", ZGrabPolicyAll, ZDNSRetryPolicy{}, SentinelZDNSStage{Name: "4hr", InTopic: "zdns_results"})
+	second := NewSentinelZDNSStageOrchestrator(db, monitor, broker, true, false, "zgrab", ZGrabPolicyAll, ZDNSRetryPolicy{}, SentinelZDNSStage{Name: "8hr", InTopic: "zdns_4hr_results"})
+	first.SetClock(clock)
+	second.SetClock(clock)
+
+	steps := []struct {
+		o       *SentinelZDNSOrchestrator
+		result  schema.ZDNSResult
+		outcome string
+	}{
+		{first, testResult("192.0.2.1", "192.0.2.2"), ChangeNew},
+		{second, testResult("192.0.2.2", "192.0.2.1"), ChangeStable},
+		{second, testResult("192.0.2.2", "192.0.2.3"), ChangeChanged},
+		{second, schema.ZDNSResult{Data: schema.ZDNSResultData{Name: "a.valid.domain"}, Status: "NXDOMAIN"}, ChangeDisappeared},
+	}
+	for idx, step := range steps {
+		clock.Advance(time.Hour)
+		outcome, err := step.o.detectChange(step.result)
+		if err != nil || outcome != step.outcome {
+			t.Errorf("Step %d: expected %s but got %s (%v)", idx, step.outcome, outcome, err)
+		}
+	}
+
+	changes := Changes(db, "a.valid.domain")
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes but got %+v", changes)
+	}
+	if changes[0].Outcome != ChangeChanged || changes[0].AddedIPv4[0] != "192.0.2.3" || changes[0].RemovedIPv4[0] != "192.0.2.1" {
+		t.Errorf("Unexpected change %+v", changes[0])
+	}
+	if changes[1].Outcome != ChangeDisappeared || len(changes[1].RemovedIPv4) != 2 {
+		t.Errorf("Unexpected change %+v", changes[1])
+	}
+
+	stable := monitor.Count(mon.ZDNSChanges, "8hr", "stable")
+	changed := monitor.Count(mon.ZDNSChanges, "8hr", "changed")
+	if stable != 1 || changed != 1 {
+		t.Errorf("Expected 1 stable and 1 changed but got %d and %d", stable, changed)
+	}
+
+	// only the disappearance happened at or after the fourth hour
+	since := ChangesSince(db, 1677664800+4*3600, 10)
+	if len(since) != 1 || since[0].Outcome != ChangeDisappeared {
+		t.Errorf("Unexpected changes since the fourth hour %+v", since)
+	}
+
+	w := httptest.NewRecorder()
+	ChangesHandler(db)(w, httptest.NewRequest("GET", "/changes?domain=a.valid.domain", nil))
+	if !strings.Contains(w.Body.String(), `"outcome":"disappeared"`) {
+		t.Errorf("Unexpected response %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	ChangesHandler(db)(w, httptest.NewRequest("GET", "/changes", nil))
+	if w.Code != 400 {
+		t.Errorf("Expected 400 without domain or since but got %d", w.Code)
+	}
+}
+
+func TestChangesWithinASecond(t *testing.T) {
+	broker := sentinelbroker.NewMemoryBroker()
+	defer broker.Stop()
+	db := sentineldb.NewTestSentinelDB("zdns-changelog-test")
+	monitor := mon.NewTestSentinelMonitor("zdns-changelog-test-stats")
+	o := NewSentinelZDNSStageOrchestrator(db, monitor, broker, true, false, "zgrab", ZGrabPolicyAll, ZDNSRetryPolicy{}, SentinelZDNSStage{Name: "4hr", InTopic: "zdns_results"})
+	o.SetClock(utils.NewFakeClock(time.Unix(1677664800, 0)))
+
+	for _, result := range []schema.ZDNSResult{
+		testResult("192.0.2.1"),
+		testResult("192.0.2.2"),
+		testResult("192.0.2.3"),
+	} {
+		if _, err := o.detectChange(result); err != nil {
+			t.Fatalf("Unable to detect change: %s", err)
+		}
+	}
+	since := ChangesSince(db, 1677664800, 10)
+	if len(since) != 2 || since[0].AddedIPv4[0] != "192.0.2.2" || since[1].AddedIPv4[0] != "192.0.2.3" {
+		t.Errorf("Expected both changes in order but got %+v", since)
+	}
+}
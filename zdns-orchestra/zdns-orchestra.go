@@ -1,143 +1,203 @@
 package zdnsorc
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"os"
-	"os/signal"
-	"strconv"
-	"syscall"
 	"time"
 
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
 	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
 	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
-	"github.com/nsqio/go-nsq"
+	sentinelpsl "github.com/gakiwate/sentinel-orchestra/sentinel-psl"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
 	log "github.com/sirupsen/logrus"
 )
 
 type SentinelZDNSOrchestrator struct {
 	db               *sentineldb.SentinelDB
 	monitor          *mon.SentinelMonitor
-	nsqHost          string
+	broker           sentinelbroker.Broker
 	ipv4             bool
 	ipv6             bool
-	consumer         nsq.Consumer
-	producer         nsq.Producer
+	stageName        string
+	nsqInTopic       string
 	nsqZDNSOutTopic  string
 	nsqZGrabOutTopic string
+	nsqRetryTopic    string
+	zgrabPolicy      string
+	retry            ZDNSRetryPolicy
 	zdnsDelay        int64
-}
-
-type ZDNSMetadata struct {
-	CertSHA1  string `json:"cert_sha1"`
-	ScanAfter string `json:"scan_after"`
-	CertType  string `json:"cert_type"`
-}
-
-type ZDNSResultData struct {
-	BaseName      string   `json:"base_name"`
-	Name          string   `json:"name"`
-	IPv4Addresses []string `json:"ipv4_addresses"`
-	IPv6Addresses []string `json:"ipv6_addresses"`
-}
-
-type ZDNSResult struct {
-	Data      ZDNSResultData `json:"data"`
-	MetaData  ZDNSMetadata   `json:"metadata"`
-	Status    string         `json:"status"`
-	Timestamp string         `json:"timestamp"`
+	clock            utils.Clock
 }
 
 type SentinelDBResult struct {
+	// Domain is only set in the registrable domain index
+	Domain        string   `json:"domain,omitempty"`
 	IPv4Addresses []string `json:"ipv4"`
 	IPv6Addresses []string `json:"ipv6"`
 	Timestamp     string   `json:"timestamp"`
+	Stage         string   `json:"stage"`
+	Status        string   `json:"status"`
+	// CNAMEs is the chain of names the queried name points to, a name
+	// hosted on a CDN usually ends in a name of the CDN
+	CNAMEs      []string            `json:"cnames"`
+	NameServers []string            `json:"nameservers,omitempty"`
+	Records     []schema.ZDNSRecord `json:"records,omitempty"`
+	Resolver    string              `json:"resolver,omitempty"`
+	Protocol    string              `json:"protocol,omitempty"`
 }
 
 type SentinelOrchestratorConfig struct {
 	db               *sentineldb.SentinelDB
 	monitor          *mon.SentinelMonitor
-	nsqHost          string
+	broker           sentinelbroker.Broker
 	ipv4             bool
 	ipv6             bool
+	stageName        string
 	nsqInTopic       string
 	nsqZDNSOutTopic  string
 	nsqZGrabOutTopic string
+	nsqRetryTopic    string
+	zgrabPolicy      string
+	retry            ZDNSRetryPolicy
 	zdnsDelay        int64
 }
 
-func NewSentinelZDNS4hrDelayOrchestrator(db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor, nsqHost string, ipv4 bool, ipv6 bool) *SentinelZDNSOrchestrator {
-	cfg4hr := &SentinelOrchestratorConfig{
-		db:               db,
-		monitor:          monitor,
-		nsqHost:          nsqHost,
-		ipv4:             ipv4,
-		ipv6:             ipv6,
-		nsqInTopic:       "zdns_results",
-		nsqZDNSOutTopic:  "zdns_4hr",
-		nsqZGrabOutTopic: "zgrab",
-		zdnsDelay:        14400, // 4hours -- 3600 sec * 4
+// SentinelZDNSStage describes one step of the ZDNS rescan chain. Results
+// arriving on InTopic are stored and rescheduled on OutTopic, Delay after
+// the scan that produced them. A stage without an OutTopic ends the chain.
+// Failed lookups are retried on RetryTopic, by default InTopic without the
+// _results suffix.
+type SentinelZDNSStage struct {
+	Name       string        `yaml:"name"`
+	InTopic    string        `yaml:"in_topic"`
+	OutTopic   string        `yaml:"out_topic"`
+	RetryTopic string        `yaml:"retry_topic"`
+	Delay      time.Duration `yaml:"delay"`
+}
+
+// ZGrab policies decide which addresses of a result are grabbed
+const (
+	// ZGrabPolicyAll grabs every address of every result
+	ZGrabPolicyAll = "all"
+	// ZGrabPolicyNew skips (domain, ip) pairs already in a zgrab rescan chain
+	ZGrabPolicyNew = "new"
+)
+
+// ValidateZDNSStages checks that the stages form a well defined chain
+func ValidateZDNSStages(stages []SentinelZDNSStage) error {
+	if len(stages) == 0 {
+		return fmt.Errorf("zdns: no stages configured")
 	}
-	return NewSentinelZDNSOrchestrator(*cfg4hr)
+	inTopics := make(map[string]bool)
+	for idx, stage := range stages {
+		if stage.InTopic == "" {
+			return fmt.Errorf("zdns: stage %d has no in_topic", idx)
+		}
+		if inTopics[stage.InTopic] {
+			return fmt.Errorf("zdns: stage %d reuses in_topic %s", idx, stage.InTopic)
+		}
+		inTopics[stage.InTopic] = true
+		if stage.Delay < 0 {
+			return fmt.Errorf("zdns: stage %d has negative delay %s", idx, stage.Delay)
+		}
+		if stage.OutTopic == "" && idx != len(stages)-1 {
+			return fmt.Errorf("zdns: only the last stage may omit out_topic (stage %d)", idx)
+		}
+	}
+	return nil
 }
 
-func NewSentinelZDNS8hrDelayOrchestrator(db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor, nsqHost string, ipv4 bool, ipv6 bool) *SentinelZDNSOrchestrator {
-	cfg8hr := &SentinelOrchestratorConfig{
+// NewSentinelZDNSStageOrchestrators creates one orchestrator per configured stage
+func NewSentinelZDNSStageOrchestrators(db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor, broker sentinelbroker.Broker, ipv4 bool, ipv6 bool, zgrabTopic string, zgrabPolicy string, retry ZDNSRetryPolicy, stages []SentinelZDNSStage) ([]*SentinelZDNSOrchestrator, error) {
+	if err := ValidateZDNSStages(stages); err != nil {
+		return nil, err
+	}
+	switch zgrabPolicy {
+	case "", ZGrabPolicyAll, ZGrabPolicyNew:
+	default:
+		return nil, fmt.Errorf("zdns: unknown zgrab policy %s", zgrabPolicy)
+	}
+	if err := retry.Validate(); err != nil {
+		return nil, err
+	}
+	if retry.retries() {
+		for idx, stage := range stages {
+			if retryTopic(stage) == stage.InTopic {
+				return nil, fmt.Errorf("zdns: stage %d needs a retry_topic", idx)
+			}
+		}
+	}
+	orchestrators := []*SentinelZDNSOrchestrator{}
+	for _, stage := range stages {
+		orchestrators = append(orchestrators, NewSentinelZDNSStageOrchestrator(db, monitor, broker, ipv4, ipv6, zgrabTopic, zgrabPolicy, retry, stage))
+	}
+	return orchestrators, nil
+}
+
+// NewSentinelZDNSStageOrchestrator creates the orchestrator for a single stage
+func NewSentinelZDNSStageOrchestrator(db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor, broker sentinelbroker.Broker, ipv4 bool, ipv6 bool, zgrabTopic string, zgrabPolicy string, retry ZDNSRetryPolicy, stage SentinelZDNSStage) *SentinelZDNSOrchestrator {
+	name := stage.Name
+	if name == "" {
+		name = stage.InTopic
+	}
+	cfg := &SentinelOrchestratorConfig{
 		db:               db,
 		monitor:          monitor,
-		nsqHost:          nsqHost,
+		broker:           broker,
 		ipv4:             ipv4,
 		ipv6:             ipv6,
-		nsqInTopic:       "zdns_4hr_results",
-		nsqZDNSOutTopic:  "zdns_8hr",
-		nsqZGrabOutTopic: "zgrab",
-		zdnsDelay:        28800, // 8hours -- 3600 sec * 8
+		stageName:        name,
+		nsqInTopic:       stage.InTopic,
+		nsqZDNSOutTopic:  stage.OutTopic,
+		nsqZGrabOutTopic: zgrabTopic,
+		nsqRetryTopic:    retryTopic(stage),
+		zgrabPolicy:      zgrabPolicy,
+		retry:            retry.withDefaults(),
+		zdnsDelay:        int64(stage.Delay.Seconds()),
 	}
-	return NewSentinelZDNSOrchestrator(*cfg8hr)
+	return NewSentinelZDNSOrchestrator(*cfg)
 }
 
 func NewSentinelZDNSOrchestrator(cfg SentinelOrchestratorConfig) *SentinelZDNSOrchestrator {
-	nsqHost := cfg.nsqHost
 	ipv4 := cfg.ipv4
 	ipv6 := cfg.ipv6
-	// Instantiate a consumer that will subscribe to the provided channel.
-	consumer, err := nsq.NewConsumer(cfg.nsqInTopic, "orchestrator", nsq.NewConfig())
-	consumer.SetLoggerLevel(nsq.LogLevelError)
-	if err != nil {
-		log.Fatal(err)
-	}
-	// Create a new NSQ producer
-	nsqUrl := fmt.Sprintf("%s:4150", nsqHost)
-	producer, err := nsq.NewProducer(nsqUrl, nsq.NewConfig())
-	producer.SetLoggerLevel(nsq.LogLevelError)
-	if err != nil {
-		// Report Error and Exit.
-		log.Fatal(err)
-	}
 
 	return &SentinelZDNSOrchestrator{
 		db:               cfg.db,
 		monitor:          cfg.monitor,
-		nsqHost:          nsqHost,
+		broker:           cfg.broker,
+		nsqInTopic:       cfg.nsqInTopic,
 		ipv4:             ipv4,
 		ipv6:             ipv6,
-		consumer:         *consumer,
-		producer:         *producer,
+		stageName:        cfg.stageName,
 		nsqZDNSOutTopic:  cfg.nsqZDNSOutTopic,
 		nsqZGrabOutTopic: cfg.nsqZGrabOutTopic,
+		nsqRetryTopic:    cfg.nsqRetryTopic,
+		zgrabPolicy:      cfg.zgrabPolicy,
+		retry:            cfg.retry,
 		zdnsDelay:        cfg.zdnsDelay,
+		clock:            utils.RealClock{},
 	}
 }
 
-func (szo *SentinelZDNSOrchestrator) feedZDNSDelayed(metadata ZDNSMetadata, name string) error {
-	scanAfter := metadata.ScanAfter
-	newScanAfter, _ := strconv.ParseInt(scanAfter, 0, 64)
-	newScanAfter = newScanAfter + szo.zdnsDelay
-
-	// fmt.Printf("New Scan After: %d; Delay: %d", newScanAfter, szo.zdnsDelay)
-	zdnsFeedInput := fmt.Sprintf("{\"domain\": \"%s\",\"metadata\": {\"cert_sha1\": \"%s\", \"scan_after\": \"%d\", \"cert_type\": \"%s\"}}", name, metadata.CertSHA1, newScanAfter, metadata.CertType)
-	err := szo.producer.Publish(szo.nsqZDNSOutTopic, []byte(zdnsFeedInput))
-	log.Info(fmt.Sprintf("ZDNS to 4/8hr: Publishing %s to channel %s", zdnsFeedInput, szo.nsqZDNSOutTopic))
+func (szo *SentinelZDNSOrchestrator) feedZDNSDelayed(metadata schema.Metadata, name string) error {
+	if szo.nsqZDNSOutTopic == "" {
+		// last stage of the chain
+		return nil
+	}
+	zdnsFeedInput, err := schema.Marshal(&schema.ZDNSInput{
+		Domain:   name,
+		Metadata: metadata.Delayed(szo.zdnsDelay),
+	})
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	err = szo.broker.Publish(szo.nsqZDNSOutTopic, zdnsFeedInput)
+	log.Info(fmt.Sprintf("ZDNS stage %s: Publishing %s to channel %s", szo.stageName, zdnsFeedInput, szo.nsqZDNSOutTopic))
 	if err != nil {
 		log.Error(err)
 		return err
@@ -145,64 +205,129 @@ func (szo *SentinelZDNSOrchestrator) feedZDNSDelayed(metadata ZDNSMetadata, name
 	return nil
 }
 
-func (szo *SentinelZDNSOrchestrator) feedZGrab(IPv4Addresses []string, IPv6Addresses []string, name string, certSHA1 string, certType string) error {
+func (szo *SentinelZDNSOrchestrator) publishZGrab(ip string, name string, metadata schema.Metadata) {
+	tnow := szo.clock.Now().Unix()
+	if szo.zgrabPolicy == ZGrabPolicyNew && szo.db.InChain(name, ip, tnow) {
+		szo.monitor.Incr(mon.ZDNSZGrabSkipped)
+		return
+	}
+	zgrabInput, err := schema.Marshal(&schema.ZGrabInput{
+		SNI:      name,
+		IP:       ip,
+		Metadata: metadata.At(tnow),
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	log.Info(fmt.Sprintf("ZDNS to Zgrab: Publishing %s to channel %s", zgrabInput, szo.nsqZGrabOutTopic))
+	err = szo.broker.Publish(szo.nsqZGrabOutTopic, zgrabInput)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	szo.monitor.Incr(mon.ZDNSZGrabPublished)
+	if err := szo.db.MarkChain(name, ip, tnow); err != nil {
+		log.Error(err)
+	}
+}
+
+func (szo *SentinelZDNSOrchestrator) feedZGrab(IPv4Addresses []string, IPv6Addresses []string, name string, metadata schema.Metadata) error {
 	if szo.ipv4 {
 		for _, ipv4 := range IPv4Addresses {
-			tnow := time.Now().Unix()
-			zgrabInput := fmt.Sprintf("{\"sni\": \"%s\", \"ip\": \"%s\", \"metadata\": {\"scan_after\": \"%d\", \"cert_sha1\": \"%s\", \"cert_type\": \"%s\"}}", name, ipv4, tnow, certSHA1, certType)
-			log.Info(fmt.Sprintf("ZDNS to Zgrab IPV4: Publishing %s to channel %s", zgrabInput, szo.nsqZDNSOutTopic))
-			err := szo.producer.Publish(szo.nsqZGrabOutTopic, []byte(zgrabInput))
-			if err != nil {
-				log.Error(err)
-			}
+			szo.publishZGrab(ipv4, name, metadata)
 		}
 	}
 	if szo.ipv6 {
 		for _, ipv6 := range IPv6Addresses {
-			tnow := time.Now().Unix()
-			zgrabInput := fmt.Sprintf("{\"sni\": \"%s\", \"ip\": \"%s\", \"metadata\": {\"scan_after\": \"%d\", \"cert_sha1\": \"%s\", \"cert_type\": \"%s\"}}", name, ipv6, tnow, certSHA1, certType)
-			log.Info(fmt.Sprintf("ZDNS to Zgrab IPV6: Publishing %s to channel %s", zgrabInput, szo.nsqZDNSOutTopic))
-			err := szo.producer.Publish(szo.nsqZGrabOutTopic, []byte(zgrabInput))
-			if err != nil {
-				log.Error(err)
-			}
+			szo.publishZGrab(ipv6, name, metadata)
 		}
 	}
 	return nil
 }
 
-func (szo *SentinelZDNSOrchestrator) FeedBroker() error {
-	// Set the Handler for messages received by this Consumer. Can be called multiple times.
-	// See also AddConcurrentHandlers.
-	szo.consumer.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
-		var Result ZDNSResult
+// SetClock replaces the clock used to timestamp scans
+func (szo *SentinelZDNSOrchestrator) SetClock(clock utils.Clock) {
+	szo.clock = clock
+}
+
+// Subscribe registers the stage handler with the broker
+func (szo *SentinelZDNSOrchestrator) Subscribe() error {
+	// Set the Handler for messages received on the stage topic.
+	return szo.broker.Subscribe(szo.nsqInTopic, "orchestrator", func(m *sentinelbroker.Message) error {
+		start := time.Now()
+		defer func() {
+			szo.monitor.ObserveLatency("zdns", szo.stageName, time.Since(start))
+		}()
+		var Result schema.ZDNSResult
 		// handle the message
-		err := json.Unmarshal(m.Body, &Result)
+		err := schema.Unmarshal(m.Body, &Result)
 		if err != nil {
 			log.Error(err)
 			return err
 		}
-		szo.monitor.Stats.Incr("monitor|zdns|result_cnt")
+		szo.monitor.Incr(mon.ZDNSResults)
 		if Result.Status != "NOERROR" {
-			szo.monitor.Stats.Incr("monitor|zdns|error_cnt")
+			szo.monitor.Incr(mon.ZDNSErrors)
 		}
-		err = szo.feedZDNSDelayed(Result.MetaData, Result.Data.Name)
-		if err != nil {
-			log.Error(err)
+		szo.monitor.Incr(mon.ZDNSStatus, szo.stageName, Result.Status)
+		if n := len(Result.Data.IPv4Addresses); n > 0 {
+			szo.monitor.IncrBy(mon.ZDNSAddresses, int64(n), szo.stageName, "ipv4")
+		}
+		if n := len(Result.Data.IPv6Addresses); n > 0 {
+			szo.monitor.IncrBy(mon.ZDNSAddresses, int64(n), szo.stageName, "ipv6")
+		}
+		action := szo.applyRetryPolicy(Result)
+		if action == StatusRetry {
+			return nil
+		}
+		// retries of this stage do not carry over to the next
+		Result.MetaData.Attempt = 0
+		if Result.MetaData.Probe == schema.ProbeRandom {
+			err = szo.recordWildcardZone(Result)
+			if err != nil {
+				log.Error(err)
+			}
 			return err
 		}
-		err = szo.feedZGrab(Result.Data.IPv4Addresses, Result.Data.IPv6Addresses, Result.Data.Name, Result.MetaData.CertSHA1, Result.MetaData.CertType)
+		if action == StatusStop {
+			szo.monitor.Incr(mon.ZDNSStopped, szo.stageName)
+		} else {
+			err = szo.feedZDNSDelayed(Result.MetaData, Result.Data.Name)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			err = szo.feedZGrab(Result.Data.IPv4Addresses, Result.Data.IPv6Addresses, Result.Data.Name, Result.MetaData)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+		}
+
+		// Compare with the previous observation of the name
+		_, err = szo.detectChange(Result)
 		if err != nil {
 			log.Error(err)
-			return err
 		}
 
 		// Add IPs to Sentinel DB
 		key := fmt.Sprintf("zdns|ips|%s", Result.Data.Name)
+		lookup := Result.Lookup()
 		sentinelResult := SentinelDBResult{
 			Timestamp:     Result.Timestamp,
 			IPv4Addresses: Result.Data.IPv4Addresses,
 			IPv6Addresses: Result.Data.IPv6Addresses,
+			Stage:         szo.stageName,
+			Status:        Result.Status,
+			CNAMEs:        lookup.CNAMEChain(),
+			NameServers:   lookup.NameServers(),
+			Records:       lookup.Answers,
+			Resolver:      lookup.Resolver,
+			Protocol:      lookup.Protocol,
+		}
+		if len(sentinelResult.CNAMEs) > 0 {
+			szo.monitor.Incr(mon.ZDNSCNAMEs)
 		}
 
 		value, err := json.Marshal(sentinelResult)
@@ -212,26 +337,31 @@ func (szo *SentinelZDNSOrchestrator) FeedBroker() error {
 		}
 		szo.db.AddResult(key, value)
 
+		// Group the result by registrable domain
+		sentinelResult.Domain = Result.Data.Name
+		value, err = json.Marshal(sentinelResult)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		sentinelpsl.Index(szo.db, szo.monitor, "zdns", Result.Data.Name, value)
+
 		return nil
-	}))
+	})
+}
+
+// Name returns the name of the stage this orchestrator runs
+func (szo *SentinelZDNSOrchestrator) Name() string {
+	return szo.stageName
+}
 
-	// Use nsqlookupd to discover nsqd instances.
-	// See also ConnectToNSQD, ConnectToNSQDs, ConnectToNSQLookupds.
-	nsqUrl := fmt.Sprintf("%s:4161", szo.nsqHost)
-	err := szo.consumer.ConnectToNSQLookupd(nsqUrl)
+// FeedBroker handles the stage topic until ctx is done
+func (szo *SentinelZDNSOrchestrator) FeedBroker(ctx context.Context) error {
+	err := szo.Subscribe()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	// TODO: Switch to a better model
-	// done channel + ticker
-	// wait for signal to exit
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-
-	// Gracefully stop the consumer.
-	szo.consumer.Stop()
-	szo.producer.Stop()
+	<-ctx.Done()
 	return nil
 }
@@ -0,0 +1,64 @@
+package zdnsorc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateZDNSStages(t *testing.T) {
+	stages := []SentinelZDNSStage{
+		{InTopic: "zdns_results", OutTopic: "zdns_1hr", Delay: time.Hour},
+		{InTopic: "zdns_1hr_results", OutTopic: "zdns_4hr", Delay: 3 * time.Hour},
+		{InTopic: "zdns_4hr_results"},
+	}
+	if err := ValidateZDNSStages(stages); err != nil {
+		t.Errorf("Expected stages to be valid but got %s", err)
+	}
+}
+
+func TestValidateZDNSStagesErrors(t *testing.T) {
+	invalid := [][]SentinelZDNSStage{
+		{},
+		{{OutTopic: "zdns_1hr", Delay: time.Hour}},
+		{{InTopic: "zdns_results", OutTopic: "zdns_1hr", Delay: -time.Hour}},
+		{{InTopic: "zdns_results"}, {InTopic: "zdns_1hr_results", OutTopic: "zdns_4hr"}},
+		{{InTopic: "zdns_results", OutTopic: "zdns_1hr"}, {InTopic: "zdns_results"}},
+	}
+	for idx, stages := range invalid {
+		if err := ValidateZDNSStages(stages); err == nil {
+			t.Errorf("Expected stages %d to be invalid", idx)
+		}
+	}
+}
+
+func TestUnknownZGrabPolicy(t *testing.T) {
+	stages := []SentinelZDNSStage{{InTopic: "zdns_results"}}
+	if _, err := NewSentinelZDNSStageOrchestrators(nil, nil, nil, true, false, "zgrab", "sometimes", ZDNSRetryPolicy{}, stages); err == nil {
+		t.Errorf("Expected an unknown zgrab policy to be rejected")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := ZDNSRetryPolicy{
+		Statuses:       map[string]string{"SERVFAIL": StatusRetry},
+		InitialBackoff: time.Minute,
+		MaxBackoff:     3 * time.Minute,
+	}.withDefaults()
+	if policy.Action("SERVFAIL") != StatusRetry || policy.Action("NXDOMAIN") != StatusContinue {
+		t.Errorf("Unexpected actions %+v", policy.Statuses)
+	}
+	for attempt, expected := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 3: 3 * time.Minute, 10: 3 * time.Minute} {
+		if backoff := policy.Backoff(attempt); backoff != expected {
+			t.Errorf("Expected backoff %s for attempt %d but got %s", expected, attempt, backoff)
+		}
+	}
+
+	stages := []SentinelZDNSStage{{InTopic: "zdns_in"}}
+	if _, err := NewSentinelZDNSStageOrchestrators(nil, nil, nil, true, false, "zgrab", ZGrabPolicyAll, policy, stages); err == nil {
+		t.Errorf("Expected a stage without retry topic to be rejected")
+	}
+	policy.Statuses["TIMEOUT"] = "later"
+	if err := policy.Validate(); err == nil {
+		t.Errorf("Expected an unknown action to be rejected")
+	}
+}
@@ -0,0 +1,128 @@
+package zdnsorc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions for a zdns status
+const (
+	// StatusContinue stores the result and feeds the next stage and zgrab
+	StatusContinue = "continue"
+	// StatusStop stores the result and ends the chain for the name
+	StatusStop = "stop"
+	// StatusRetry resolves the name again after a backoff. Once the attempts
+	// are used up the result is handled like continue.
+	StatusRetry = "retry"
+)
+
+// ZDNSRetryPolicy decides what happens to results by their status
+type ZDNSRetryPolicy struct {
+	// Statuses maps a zdns status to an action. Statuses not listed continue.
+	Statuses       map[string]string `yaml:"statuses"`
+	MaxAttempts    int               `yaml:"max_attempts"`
+	InitialBackoff time.Duration     `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration     `yaml:"max_backoff"`
+}
+
+func (p ZDNSRetryPolicy) withDefaults() ZDNSRetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 30 * time.Second
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = 10 * p.InitialBackoff
+	}
+	return p
+}
+
+// Validate checks the actions of the policy
+func (p ZDNSRetryPolicy) Validate() error {
+	for status, action := range p.Statuses {
+		switch action {
+		case StatusContinue, StatusStop, StatusRetry:
+		default:
+			return fmt.Errorf("zdns: unknown action %s for status %s", action, status)
+		}
+	}
+	return nil
+}
+
+func (p ZDNSRetryPolicy) retries() bool {
+	for _, action := range p.Statuses {
+		if action == StatusRetry {
+			return true
+		}
+	}
+	return false
+}
+
+// Action returns what to do with a result of status
+func (p ZDNSRetryPolicy) Action(status string) string {
+	if action, ok := p.Statuses[status]; ok {
+		return action
+	}
+	return StatusContinue
+}
+
+// Backoff returns how long to wait before the given retry, starting at 1
+func (p ZDNSRetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+// retryTopic is the zdns worker topic of a stage, whose results arrive on
+// <topic>_results
+func retryTopic(stage SentinelZDNSStage) string {
+	if stage.RetryTopic != "" {
+		return stage.RetryTopic
+	}
+	return strings.TrimSuffix(stage.InTopic, "_results")
+}
+
+// applyRetryPolicy returns the action for the result. For retry the name has
+// already been sent back to zdns.
+func (szo *SentinelZDNSOrchestrator) applyRetryPolicy(result schema.ZDNSResult) string {
+	action := szo.retry.Action(result.Status)
+	if action != StatusRetry {
+		return action
+	}
+
+	metadata := result.MetaData
+	metadata.Attempt++
+	if metadata.Attempt > szo.retry.MaxAttempts {
+		szo.monitor.Incr(mon.ZDNSRetriesExhausted, szo.stageName)
+		return StatusContinue
+	}
+	backoff := szo.retry.Backoff(metadata.Attempt)
+	metadata = metadata.At(szo.clock.Now().Add(backoff).Unix())
+
+	zdnsInput, err := schema.Marshal(&schema.ZDNSInput{
+		Domain:   result.Data.Name,
+		Metadata: metadata,
+	})
+	if err != nil {
+		log.Error(err)
+		return StatusContinue
+	}
+	if err := szo.broker.Publish(szo.nsqRetryTopic, zdnsInput); err != nil {
+		log.Error(err)
+		return StatusContinue
+	}
+	szo.monitor.Incr(mon.ZDNSRetries, szo.stageName)
+	log.Info(fmt.Sprintf("ZDNS stage %s: Retrying %s in %s after %s", szo.stageName, result.Data.Name, backoff, result.Status))
+	return StatusRetry
+}
@@ -0,0 +1,44 @@
+package zdnsorc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+)
+
+// SentinelDBWildcard is stored under zdns|wildcard|<zone> and records whether
+// a name that should not exist resolved in the zone
+type SentinelDBWildcard struct {
+	Wildcard      bool     `json:"wildcard"`
+	Probe         string   `json:"probe"`
+	Status        string   `json:"status"`
+	IPv4Addresses []string `json:"ipv4"`
+	IPv6Addresses []string `json:"ipv6"`
+	Timestamp     string   `json:"timestamp"`
+}
+
+// recordWildcardZone stores the outcome of a random probe. The probe is not
+// rescheduled or grabbed.
+func (szo *SentinelZDNSOrchestrator) recordWildcardZone(result schema.ZDNSResult) error {
+	name := result.Data.Name
+	zone := name[strings.Index(name, ".")+1:]
+	wildcard := result.Status == "NOERROR" && len(result.Data.IPv4Addresses)+len(result.Data.IPv6Addresses) > 0
+	szo.monitor.Incr(mon.ZDNSWildcardZones, strconv.FormatBool(wildcard))
+
+	value, err := json.Marshal(SentinelDBWildcard{
+		Wildcard:      wildcard,
+		Probe:         name,
+		Status:        result.Status,
+		IPv4Addresses: result.Data.IPv4Addresses,
+		IPv6Addresses: result.Data.IPv6Addresses,
+		Timestamp:     result.Timestamp,
+	})
+	if err != nil {
+		return err
+	}
+	return szo.db.Set(fmt.Sprintf("zdns|wildcard|%s", zone), value)
+}
@@ -0,0 +1,91 @@
+package zgraborc
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"math/big"
+	"strings"
+
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
+)
+
+// Outcomes of comparing the CT logged certificate with the one served
+const (
+	AnalysisMatch          = "match"
+	AnalysisMismatch       = "mismatch"
+	AnalysisNoTLS          = "no_tls"
+	AnalysisHandshakeError = "handshake_error"
+)
+
+// zgrab2 statuses that mean we never reached a TLS handshake
+var noTLSStatuses = map[string]bool{
+	"":                   true,
+	"connection-refused": true,
+	"connection-timeout": true,
+	"io-timeout":         true,
+}
+
+type ZGrabAnalysis struct {
+	Outcome         string
+	PresentedSHA1   string
+	PresentedSerial string
+	PresentedIssuer string
+}
+
+// AnalyzeZGrabResult compares the leaf certificate presented during the TLS
+// handshake with the certificate that was logged in CT. A precertificate and
+// the final certificate issued for it share issuer and serial number, so a
+// served certificate with the logged issuer and serial counts as a match.
+func AnalyzeZGrabResult(result schema.ZGrabResult) ZGrabAnalysis {
+	tls := result.Data.TLS
+	leaf := tls.Result.HandshakeLog.ServerCertificates.Certificate
+
+	analysis := ZGrabAnalysis{}
+	if len(leaf.Raw) == 0 {
+		analysis.PresentedSHA1 = utils.FormatSHA1(leaf.Parsed.FingerprintSHA1)
+		if analysis.PresentedSHA1 == "" {
+			if noTLSStatuses[tls.Status] {
+				analysis.Outcome = AnalysisNoTLS
+			} else {
+				analysis.Outcome = AnalysisHandshakeError
+			}
+			return analysis
+		}
+	} else {
+		fingerprint := sha1.Sum(leaf.Raw)
+		analysis.PresentedSHA1 = hex.EncodeToString(fingerprint[:])
+		if cert, err := x509.ParseCertificate(leaf.Raw); err == nil {
+			analysis.PresentedSerial = strings.ToUpper(cert.SerialNumber.Text(16))
+			analysis.PresentedIssuer = utils.NameFields(cert.Issuer)["aggregated"]
+		}
+	}
+
+	switch {
+	case analysis.PresentedSHA1 == utils.FormatSHA1(result.MetaData.CertSHA1):
+		analysis.Outcome = AnalysisMatch
+	// serials are only unique per issuer
+	case analysis.PresentedIssuer != "" && analysis.PresentedIssuer == result.MetaData.CertIssuer &&
+		sameSerial(analysis.PresentedSerial, result.MetaData.CertSerial):
+		analysis.Outcome = AnalysisMatch
+	default:
+		analysis.Outcome = AnalysisMismatch
+	}
+	return analysis
+}
+
+func sameSerial(a string, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	x, ok := new(big.Int).SetString(strings.ReplaceAll(a, ":", ""), 16)
+	if !ok {
+		return false
+	}
+	y, ok := new(big.Int).SetString(strings.ReplaceAll(b, ":", ""), 16)
+	if !ok {
+		return false
+	}
+	return x.Cmp(y) == 0
+}
@@ -0,0 +1,83 @@
+package zgraborc
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	testutils "github.com/gakiwate/sentinel-orchestra/sentinel-testutils"
+)
+
+const testIssuer = "/C=US/O=Let's Encrypt/CN=R3"
+
+func testCertificate(t *testing.T, serial int64) []byte {
+	return testutils.Certificate(t, testutils.TestCert{Serial: serial, Domains: []string{"www.valid.domain"}, Issuer: testutils.R3})
+}
+
+func testResult(status string, raw []byte, metadata schema.Metadata) schema.ZGrabResult {
+	result := schema.ZGrabResult{IP: "192.0.2.1", Domain: "www.valid.domain", MetaData: metadata}
+	result.Data.TLS.Status = status
+	result.Data.TLS.Result.HandshakeLog.ServerCertificates.Certificate.Raw = raw
+	return result
+}
+
+func TestAnalyzeSameCertificate(t *testing.T) {
+	raw := testCertificate(t, 4242)
+	fingerprint := sha1.Sum(raw)
+	result := testResult("success", raw, schema.Metadata{CertSHA1: hex.EncodeToString(fingerprint[:])})
+	analysis := AnalyzeZGrabResult(result)
+	if analysis.Outcome != AnalysisMatch {
+		t.Errorf("Expected %s but got %s", AnalysisMatch, analysis.Outcome)
+	}
+}
+
+func TestAnalyzeFinalCertificate(t *testing.T) {
+	raw := testCertificate(t, 4242)
+	// 4242 is 0x1092; the precert shares the serial but not the fingerprint
+	result := testResult("success", raw, schema.Metadata{CertSHA1: "0000", CertSerial: "001092", CertIssuer: testIssuer})
+	analysis := AnalyzeZGrabResult(result)
+	if analysis.Outcome != AnalysisMatch {
+		t.Errorf("Expected %s but got %s", AnalysisMatch, analysis.Outcome)
+	}
+	if analysis.PresentedSerial != "1092" {
+		t.Errorf("Expected serial 1092 but got %s", analysis.PresentedSerial)
+	}
+}
+
+func TestAnalyzeOtherIssuer(t *testing.T) {
+	raw := testCertificate(t, 4242)
+	// serials are only unique per issuer
+	result := testResult("success", raw, schema.Metadata{CertSHA1: "0000", CertSerial: "1092", CertIssuer: "/C=US/O=Other CA/CN=E1"})
+	analysis := AnalyzeZGrabResult(result)
+	if analysis.Outcome != AnalysisMismatch {
+		t.Errorf("Expected %s but got %s", AnalysisMismatch, analysis.Outcome)
+	}
+	if analysis.PresentedIssuer != testIssuer {
+		t.Errorf("Expected issuer %s but got %s", testIssuer, analysis.PresentedIssuer)
+	}
+}
+
+func TestAnalyzeDifferentCertificate(t *testing.T) {
+	raw := testCertificate(t, 4242)
+	result := testResult("success", raw, schema.Metadata{CertSHA1: "0000", CertSerial: "1093", CertIssuer: testIssuer})
+	analysis := AnalyzeZGrabResult(result)
+	if analysis.Outcome != AnalysisMismatch {
+		t.Errorf("Expected %s but got %s", AnalysisMismatch, analysis.Outcome)
+	}
+}
+
+func TestAnalyzeFailedGrabs(t *testing.T) {
+	outcomes := map[string]string{
+		"connection-refused": AnalysisNoTLS,
+		"connection-timeout": AnalysisNoTLS,
+		"protocol-error":     AnalysisHandshakeError,
+		"unknown-error":      AnalysisHandshakeError,
+	}
+	for status, expected := range outcomes {
+		analysis := AnalyzeZGrabResult(testResult(status, nil, schema.Metadata{CertSHA1: "0000"}))
+		if analysis.Outcome != expected {
+			t.Errorf("Expected %s for %s but got %s", expected, status, analysis.Outcome)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package zgraborc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
+	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
+	log "github.com/sirupsen/logrus"
+)
+
+// SweepChains removes expired rescan chain entries every ChainGrace until ctx
+// is done. Both zdns and zgrab write them, so it runs as a stage of its own.
+func SweepChains(ctx context.Context, db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor) error {
+	ticker := time.NewTicker(sentineldb.ChainGrace)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			expired, err := db.SweepChains(now.Unix())
+			if err != nil {
+				log.Error(err)
+			}
+			monitor.IncrBy(mon.ZGrabChainsExpired, int64(expired))
+			log.Info(fmt.Sprintf("ZGrab: expired %d rescan chain entries", expired))
+		}
+	}
+}
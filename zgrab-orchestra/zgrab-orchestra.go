@@ -1,124 +1,204 @@
 package zgraborc
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"os"
-	"os/signal"
-	"strconv"
-	"syscall"
+	"time"
 
+	sentinelbroker "github.com/gakiwate/sentinel-orchestra/sentinel-broker"
+	sentineldb "github.com/gakiwate/sentinel-orchestra/sentinel-db"
 	mon "github.com/gakiwate/sentinel-orchestra/sentinel-monitor"
-	"github.com/nsqio/go-nsq"
+	sentinelpsl "github.com/gakiwate/sentinel-orchestra/sentinel-psl"
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+	utils "github.com/gakiwate/sentinel-orchestra/sentinel-utils"
 	log "github.com/sirupsen/logrus"
 )
 
 type SentinelZGrabOrchestrator struct {
+	db               *sentineldb.SentinelDB
 	monitor          *mon.SentinelMonitor
-	nsqHost          string
-	consumer         nsq.Consumer
-	producer         nsq.Producer
+	broker           sentinelbroker.Broker
+	stageName        string
+	nsqInTopic       string
 	nsqZGrabOutTopic string
 	zgrabDelay       int64
+	clock            utils.Clock
 }
 
-type ZGrabMetadata struct {
-	CertSHA1  string `json:"cert_sha1"`
-	ScanAfter string `json:"scan_after"`
-	CertType  string `json:"cert_type"`
-}
-
-type ZGrabResult struct {
-	IP       string        `json:"ip"`
-	Domain   string        `json:"domain"`
-	MetaData ZGrabMetadata `json:"metadata"`
+type SentinelDBResult struct {
+	// Domain and IP are only set in the registrable domain index
+	Domain          string `json:"domain,omitempty"`
+	IP              string `json:"ip,omitempty"`
+	Timestamp       string `json:"timestamp"`
+	Stage           string `json:"stage"`
+	Status          string `json:"status"`
+	Error           string `json:"error,omitempty"`
+	CertSHA1        string `json:"cert_sha1"`
+	PresentedSHA1   string `json:"presented_sha1"`
+	PresentedSerial string `json:"presented_serial,omitempty"`
+	Analysis        string `json:"analysis"`
 }
 
 type SentinelOrchestratorConfig struct {
+	db               *sentineldb.SentinelDB
 	monitor          *mon.SentinelMonitor
-	nsqHost          string
+	broker           sentinelbroker.Broker
+	stageName        string
 	nsqInTopic       string
 	nsqZGrabOutTopic string
 	zgrabDelay       int64
 }
 
-func NewSentinelZgrab4hrDelayOrchestrator(monitor *mon.SentinelMonitor, nsqHost string) *SentinelZGrabOrchestrator {
-	cfg4hr := &SentinelOrchestratorConfig{
-		monitor:          monitor,
-		nsqHost:          nsqHost,
-		nsqInTopic:       "zgrab_results",
-		nsqZGrabOutTopic: "zgrab_4hr",
-		zgrabDelay:       14400, // 4hours -- 3600 sec * 4
+// SentinelZGrabStage describes one step of the ZGrab rescan chain. Results
+// arriving on InTopic are rescheduled on OutTopic, Delay after the grab that
+// produced them. A stage without an OutTopic ends the chain.
+type SentinelZGrabStage struct {
+	Name     string        `yaml:"name"`
+	InTopic  string        `yaml:"in_topic"`
+	OutTopic string        `yaml:"out_topic"`
+	Delay    time.Duration `yaml:"delay"`
+}
+
+// ValidateZGrabStages checks that the stages form a well defined chain
+func ValidateZGrabStages(stages []SentinelZGrabStage) error {
+	if len(stages) == 0 {
+		return fmt.Errorf("zgrab: no stages configured")
 	}
-	return NewSentinelZGrabOrchestrator(*cfg4hr)
+	inTopics := make(map[string]bool)
+	for idx, stage := range stages {
+		if stage.InTopic == "" {
+			return fmt.Errorf("zgrab: stage %d has no in_topic", idx)
+		}
+		if inTopics[stage.InTopic] {
+			return fmt.Errorf("zgrab: stage %d reuses in_topic %s", idx, stage.InTopic)
+		}
+		inTopics[stage.InTopic] = true
+		if stage.Delay < 0 {
+			return fmt.Errorf("zgrab: stage %d has negative delay %s", idx, stage.Delay)
+		}
+		if stage.OutTopic == "" && idx != len(stages)-1 {
+			return fmt.Errorf("zgrab: only the last stage may omit out_topic (stage %d)", idx)
+		}
+	}
+	return nil
 }
 
-func NewSentinelZgrab8hrDelayOrchestrator(monitor *mon.SentinelMonitor, nsqHost string) *SentinelZGrabOrchestrator {
-	cfg8hr := &SentinelOrchestratorConfig{
-		monitor:          monitor,
-		nsqHost:          nsqHost,
-		nsqInTopic:       "zgrab_4hr_results",
-		nsqZGrabOutTopic: "zgrab_8hr",
-		zgrabDelay:       28800, // 8hours -- 3600 sec * 8
+// NewSentinelZGrabStageOrchestrators creates one orchestrator per configured stage
+func NewSentinelZGrabStageOrchestrators(db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor, broker sentinelbroker.Broker, stages []SentinelZGrabStage) ([]*SentinelZGrabOrchestrator, error) {
+	if err := ValidateZGrabStages(stages); err != nil {
+		return nil, err
 	}
-	return NewSentinelZGrabOrchestrator(*cfg8hr)
+	orchestrators := []*SentinelZGrabOrchestrator{}
+	for _, stage := range stages {
+		orchestrators = append(orchestrators, NewSentinelZGrabStageOrchestrator(db, monitor, broker, stage))
+	}
+	return orchestrators, nil
 }
 
-func NewSentinelZGrabOrchestrator(cfg SentinelOrchestratorConfig) *SentinelZGrabOrchestrator {
-	nsqHost := cfg.nsqHost
-	// Instantiate a consumer that will subscribe to the provided channel.
-	consumer, err := nsq.NewConsumer(cfg.nsqInTopic, "orchestrator", nsq.NewConfig())
-	consumer.SetLoggerLevel(nsq.LogLevelError)
-	if err != nil {
-		log.Fatal(err)
+// NewSentinelZGrabStageOrchestrator creates the orchestrator for a single stage
+func NewSentinelZGrabStageOrchestrator(db *sentineldb.SentinelDB, monitor *mon.SentinelMonitor, broker sentinelbroker.Broker, stage SentinelZGrabStage) *SentinelZGrabOrchestrator {
+	name := stage.Name
+	if name == "" {
+		name = stage.InTopic
 	}
-	// Create a new NSQ producer
-	nsqUrl := fmt.Sprintf("%s:4150", nsqHost)
-	producer, err := nsq.NewProducer(nsqUrl, nsq.NewConfig())
-	producer.SetLoggerLevel(nsq.LogLevelError)
-	if err != nil {
-		// Report Error and Exit.
-		log.Fatal(err)
+	cfg := &SentinelOrchestratorConfig{
+		db:               db,
+		monitor:          monitor,
+		broker:           broker,
+		stageName:        name,
+		nsqInTopic:       stage.InTopic,
+		nsqZGrabOutTopic: stage.OutTopic,
+		zgrabDelay:       int64(stage.Delay.Seconds()),
 	}
+	return NewSentinelZGrabOrchestrator(*cfg)
+}
 
+func NewSentinelZGrabOrchestrator(cfg SentinelOrchestratorConfig) *SentinelZGrabOrchestrator {
 	return &SentinelZGrabOrchestrator{
+		db:               cfg.db,
 		monitor:          cfg.monitor,
-		nsqHost:          nsqHost,
-		consumer:         *consumer,
-		producer:         *producer,
+		broker:           cfg.broker,
+		nsqInTopic:       cfg.nsqInTopic,
+		stageName:        cfg.stageName,
 		nsqZGrabOutTopic: cfg.nsqZGrabOutTopic,
 		zgrabDelay:       cfg.zgrabDelay,
+		clock:            utils.RealClock{},
 	}
 }
 
-func (szo *SentinelZGrabOrchestrator) feedZGrabDelayed(metadata ZGrabMetadata, IP string, Domain string) error {
-	ScanAfter := metadata.ScanAfter
-	newScanAfter, _ := strconv.ParseInt(ScanAfter, 0, 64)
-	newScanAfter = newScanAfter + szo.zgrabDelay
-	zgrabInput := fmt.Sprintf("{\"sni\": \"%s\", \"ip\": \"%s\", \"metadata\": {\"scan_after\": \"%d\", \"cert_sha1\": \"%s\", \"cert_type\": \"%s\"}}", Domain, IP, newScanAfter, metadata.CertSHA1, metadata.CertType)
+func (szo *SentinelZGrabOrchestrator) feedZGrabDelayed(metadata schema.Metadata, IP string, Domain string) error {
+	if szo.nsqZGrabOutTopic == "" {
+		// last stage of the chain
+		if err := szo.db.EndChain(Domain, IP, metadata.ScanAfterUnix()); err != nil {
+			log.Error(err)
+		}
+		return nil
+	}
+	delayed := metadata.Delayed(szo.zgrabDelay)
+	zgrabInput, err := schema.Marshal(&schema.ZGrabInput{
+		SNI:      Domain,
+		IP:       IP,
+		Metadata: delayed,
+	})
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
 
-	err := szo.producer.Publish(szo.nsqZGrabOutTopic, []byte(zgrabInput))
-	log.Info(fmt.Sprintf("Zgrab to 4/8hr: Publishing %s to channel %s", zgrabInput, szo.nsqZGrabOutTopic))
+	err = szo.broker.Publish(szo.nsqZGrabOutTopic, zgrabInput)
+	log.Info(fmt.Sprintf("Zgrab stage %s: Publishing %s to channel %s", szo.stageName, zgrabInput, szo.nsqZGrabOutTopic))
 
 	if err != nil {
 		log.Error(err)
+		return nil
+	}
+	if err := szo.db.MarkChain(Domain, IP, delayed.ScanAfterUnix()); err != nil {
+		log.Error(err)
 	}
 
 	return nil
 }
 
-func (szo *SentinelZGrabOrchestrator) FeedBroker() error {
-	// Set the Handler for messages received by this Consumer. Can be called multiple times.
-	// See also AddConcurrentHandlers.
-	szo.consumer.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
-		var Result ZGrabResult
+func (szo *SentinelZGrabOrchestrator) sentinelResult(result schema.ZGrabResult, analysis ZGrabAnalysis) SentinelDBResult {
+	tls := result.Data.TLS
+	timestamp := tls.Timestamp
+	if timestamp == "" {
+		timestamp = szo.clock.Now().UTC().Format(time.RFC3339)
+	}
+	return SentinelDBResult{
+		Timestamp:       timestamp,
+		Stage:           szo.stageName,
+		Status:          tls.Status,
+		Error:           tls.Error,
+		CertSHA1:        result.MetaData.CertSHA1,
+		PresentedSHA1:   analysis.PresentedSHA1,
+		PresentedSerial: analysis.PresentedSerial,
+		Analysis:        analysis.Outcome,
+	}
+}
+
+// SetClock replaces the clock used to timestamp scans
+func (szo *SentinelZGrabOrchestrator) SetClock(clock utils.Clock) {
+	szo.clock = clock
+}
+
+// Subscribe registers the stage handler with the broker
+func (szo *SentinelZGrabOrchestrator) Subscribe() error {
+	// Set the Handler for messages received on the stage topic.
+	return szo.broker.Subscribe(szo.nsqInTopic, "orchestrator", func(m *sentinelbroker.Message) error {
+		start := time.Now()
+		defer func() {
+			szo.monitor.ObserveLatency("zgrab", szo.stageName, time.Since(start))
+		}()
+		var Result schema.ZGrabResult
 		// handle the message
-		err := json.Unmarshal(m.Body, &Result)
+		err := schema.Unmarshal(m.Body, &Result)
 		if err != nil {
 			log.Error(err)
 			return err
 		}
-		szo.monitor.Stats.Incr("stats.zgrab.result_cnt")
+		szo.monitor.Incr(mon.ZGrabResults)
 		err = szo.feedZGrabDelayed(Result.MetaData, Result.IP, Result.Domain)
 
 		if err != nil {
@@ -126,26 +206,46 @@ func (szo *SentinelZGrabOrchestrator) FeedBroker() error {
 			return err
 		}
 
+		// Compare the served certificate with the CT logged one
+		analysis := AnalyzeZGrabResult(Result)
+		szo.monitor.Incr(mon.ZGrabAnalysis, szo.stageName, analysis.Outcome)
+
+		// Add the grab to Sentinel DB
+		key := fmt.Sprintf("zgrab|%s|%s", Result.Domain, Result.IP)
+		sentinelResult := szo.sentinelResult(Result, analysis)
+		value, err := json.Marshal(sentinelResult)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		szo.db.AddResult(key, value)
+
+		// Group the grab by registrable domain
+		sentinelResult.Domain = Result.Domain
+		sentinelResult.IP = Result.IP
+		value, err = json.Marshal(sentinelResult)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		sentinelpsl.Index(szo.db, szo.monitor, "zgrab", Result.Domain, value)
+
 		return nil
-	}))
+	})
+}
 
-	// Use nsqlookupd to discover nsqd instances.
-	// See also ConnectToNSQD, ConnectToNSQDs, ConnectToNSQLookupds.
-	nsqUrl := fmt.Sprintf("%s:4161", szo.nsqHost)
-	err := szo.consumer.ConnectToNSQLookupd(nsqUrl)
+// Name returns the name of the stage this orchestrator runs
+func (szo *SentinelZGrabOrchestrator) Name() string {
+	return szo.stageName
+}
+
+// FeedBroker handles the stage topic until ctx is done
+func (szo *SentinelZGrabOrchestrator) FeedBroker(ctx context.Context) error {
+	err := szo.Subscribe()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	// TODO: Switch to a better model
-	// done channel + ticker
-	// wait for signal to exit
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-
-	// Gracefully stop the consumer.
-	szo.consumer.Stop()
-	szo.producer.Stop()
+	<-ctx.Done()
 	return nil
 }
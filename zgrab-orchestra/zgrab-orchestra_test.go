@@ -0,0 +1,59 @@
+package zgraborc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	schema "github.com/gakiwate/sentinel-orchestra/sentinel-schema"
+)
+
+func TestValidateZGrabStages(t *testing.T) {
+	stages := []SentinelZGrabStage{
+		{InTopic: "zgrab_results", OutTopic: "zgrab_1hr", Delay: time.Hour},
+		{InTopic: "zgrab_1hr_results", OutTopic: "zgrab_4hr", Delay: 3 * time.Hour},
+		{InTopic: "zgrab_4hr_results"},
+	}
+	if err := ValidateZGrabStages(stages); err != nil {
+		t.Errorf("Expected stages to be valid but got %s", err)
+	}
+}
+
+func TestValidateZGrabStagesErrors(t *testing.T) {
+	invalid := [][]SentinelZGrabStage{
+		{},
+		{{OutTopic: "zgrab_1hr", Delay: time.Hour}},
+		{{InTopic: "zgrab_results", OutTopic: "zgrab_1hr", Delay: -time.Hour}},
+		{{InTopic: "zgrab_results"}, {InTopic: "zgrab_1hr_results", OutTopic: "zgrab_4hr"}},
+		{{InTopic: "zgrab_results", OutTopic: "zgrab_1hr"}, {InTopic: "zgrab_results"}},
+	}
+	for idx, stages := range invalid {
+		if err := ValidateZGrabStages(stages); err == nil {
+			t.Errorf("Expected stages %d to be invalid", idx)
+		}
+	}
+}
+
+func TestSentinelResult(t *testing.T) {
+	body := []byte(`{"ip": "192.0.2.1", "domain": "www.valid.domain",
+		"data": {"tls": {"status": "success", "protocol": "tls", "timestamp": "2023-03-01T10:00:00Z",
+			"result": {"handshake_log": {"server_certificates": {"certificate": {"parsed": {"fingerprint_sha1": "abcdef"}}}}}}},
+		"metadata": {"cert_sha1": "123456", "scan_after": "1677664800", "cert_type": "PrecertLogEntry"}}`)
+	var result schema.ZGrabResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("Unable to parse zgrab result: %s", err)
+	}
+	szo := &SentinelZGrabOrchestrator{stageName: "4hr"}
+	record := szo.sentinelResult(result, AnalyzeZGrabResult(result))
+	expected := SentinelDBResult{
+		Timestamp:     "2023-03-01T10:00:00Z",
+		Stage:         "4hr",
+		Status:        "success",
+		CertSHA1:      "123456",
+		PresentedSHA1: "abcdef",
+		Analysis:      AnalysisMismatch,
+	}
+	if record != expected {
+		t.Errorf("Expected %+v but got %+v", expected, record)
+	}
+}